@@ -1,19 +1,33 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/go-chi/chi/v5"
 	"github.com/repriest/url-shortener/internal/config"
 	"github.com/repriest/url-shortener/internal/handlers"
+	"github.com/repriest/url-shortener/internal/healthcheck"
+	"github.com/repriest/url-shortener/internal/keyring"
 	"github.com/repriest/url-shortener/internal/logger"
+	"github.com/repriest/url-shortener/internal/metrics"
+	"github.com/repriest/url-shortener/internal/requestid"
+	"github.com/repriest/url-shortener/internal/storage/breaker"
+	"github.com/repriest/url-shortener/internal/storage/encrypted"
 	"github.com/repriest/url-shortener/internal/storage/file"
+	"github.com/repriest/url-shortener/internal/storage/instrumented"
 	"github.com/repriest/url-shortener/internal/storage/memory"
 	"github.com/repriest/url-shortener/internal/storage/postgres"
 	t "github.com/repriest/url-shortener/internal/storage/types"
+	"github.com/repriest/url-shortener/internal/tracing"
 	"github.com/repriest/url-shortener/internal/zipper"
 	"go.uber.org/zap"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func initConfig() (*config.Config, error) {
@@ -31,9 +45,69 @@ func initLogger(cfg *config.Config) error {
 	return nil
 }
 
+func initTemplates(cfg *config.Config) error {
+	if err := handlers.LoadTemplates(cfg.TemplateDir); err != nil {
+		return err
+	}
+	return nil
+}
+
+func initTracing(cfg *config.Config) (func(context.Context) error, error) {
+	return tracing.Init(tracing.Options{
+		Exporter:     cfg.TraceExporter,
+		FilePath:     cfg.TraceFilePath,
+		OTLPEndpoint: cfg.TraceOTLPEndpoint,
+		SampleRatio:  cfg.TraceSampleRatio,
+	})
+}
+
 func initStorage(cfg *config.Config) (t.Storage, error) {
+	st, err := initBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
+	// metrics are recorded next to the backend, so they show its own latency
+	st = instrumented.NewInstrumented(st, backendName(st))
+
+	if len(cfg.EncryptionKeys) > 0 {
+		kr, err := keyring.New(cfg.EncryptionKeys, cfg.EncryptionActiveKey, cfg.URLHashKey)
+		if err != nil {
+			st.Close()
+			return nil, fmt.Errorf("could not load keyring: %w", err)
+		}
+		es := encrypted.NewEncryptedStorage(st, kr)
+		// links from before encryption are deduplicated by the keyed hash too
+		migrated, err := es.MigrateHashes(context.Background())
+		if err != nil {
+			st.Close()
+			return nil, fmt.Errorf("could not migrate url hashes: %w", err)
+		}
+		if migrated > 0 {
+			logger.Log.Info("migrated url hashes to the keyed hash", zap.Int("entries", migrated))
+		}
+		st = es
+	}
+
+	st = breaker.NewBreaker(st, cfg.BreakerThreshold, cfg.BreakerOpenTimeout)
+
+	if cfg.HealthCheckInterval > 0 {
+		st = healthcheck.NewChecker(st, healthcheck.Options{
+			Interval:          cfg.HealthCheckInterval,
+			Timeout:           cfg.HealthCheckTimeout,
+			Concurrency:       cfg.HealthCheckConcurrency,
+			HostInterval:      cfg.HealthCheckHostInterval,
+			FailureThreshold:  cfg.HealthCheckFailureThreshold,
+			HistorySize:       cfg.HealthCheckHistory,
+			AllowPrivateHosts: cfg.AllowPrivateHosts,
+		})
+	}
+
+	return st, nil
+}
+
+func initBackend(cfg *config.Config) (t.Storage, error) {
 	if cfg.DatabaseDSN != "" {
-		st, err := postgres.NewPgStorage(cfg.DatabaseDSN)
+		st, err := postgres.NewPgStorage(cfg.DatabaseDSN, cfg.DatabaseReplicaDSNs, cfg.ReplicaMaxLag, cfg.ReplicaCheckInterval)
 		if err != nil {
 			return nil, fmt.Errorf("could not connect to postgres: %w", err)
 		}
@@ -48,9 +122,28 @@ func initStorage(cfg *config.Config) (t.Storage, error) {
 		return st, nil
 	}
 
+	if cfg.MemorySnapshotPath != "" {
+		st, err := memory.NewSnapshotMemoryStorage(cfg.MemorySnapshotPath, cfg.MemorySnapshotInterval)
+		if err != nil {
+			return nil, fmt.Errorf("could not restore memory snapshot %s: %w", cfg.MemorySnapshotPath, err)
+		}
+		return st, nil
+	}
+
 	return memory.NewMemoryStorage()
 }
 
+func backendName(st t.Storage) string {
+	switch st.(type) {
+	case *postgres.PGStorage:
+		return "postgres"
+	case *file.FileStorage:
+		return "file"
+	default:
+		return "memory"
+	}
+}
+
 func closeStorage(st t.Storage) {
 	if err := st.Close(); err != nil {
 		logger.Log.Error("could not close storage", zap.Error(err))
@@ -60,19 +153,135 @@ func closeStorage(st t.Storage) {
 func initRouter(cfg *config.Config, st t.Storage) *chi.Mux {
 	h := handlers.NewHandler(cfg, st)
 	r := chi.NewRouter()
+	r.Use(tracing.Middleware, requestid.Middleware, metrics.Middleware)
+	accessLog := logger.NewAccessLog(logger.AccessLogOptions{
+		Format:        cfg.AccessLogFormat,
+		LogBodies:     cfg.AccessLogBodies,
+		MaxBodySize:   cfg.AccessLogMaxBodySize,
+		RedactParams:  cfg.AccessLogRedactParams,
+		RedactCookies: cfg.AccessLogRedactCookies,
+		SampleRates:   cfg.AccessLogSampleRates,
+	})
 
 	r.Get("/ping", h.PingHandler)
+	r.Get("/.well-known/apple-app-site-association", h.AppleAppSiteAssociationHandler)
+	r.Get("/apple-app-site-association", h.AppleAppSiteAssociationHandler)
+	r.Get("/.well-known/assetlinks.json", h.AssetLinksHandler)
 	r.Group(func(r chi.Router) {
-		r.Use(logger.RequestLogger, logger.ResponseLogger, zipper.GzipMiddleware)
-		r.Post("/", h.ShortenHandler)
+		// request IDs are added to error bodies before they are compressed
+		r.Use(accessLog.Middleware, zipper.GzipMiddleware, requestid.ErrorBodies)
 		r.Get("/{id}", h.ExpandHandler)
-		r.Post("/api/shorten", h.ShortenJSONHandler)
-		r.Post("/api/shorten/batch", h.ShortenBatchHandler)
+		r.Head("/{id}", h.ExpandHandler)
+		// a forwarded "/qr" path suffix is shadowed by the QR code
+		r.Get("/{id}/qr", h.QRHandler)
+		r.Get("/{id}/*", h.ExpandHandler)
+		r.Head("/{id}/*", h.ExpandHandler)
+		r.Post("/{id}", h.UnlockHandler)
+		r.Post("/{id}/*", h.UnlockHandler)
+
+		// shortening is refused while the server is read-only, new links are
+		// owned by the user in the user cookie
+		r.Group(func(r chi.Router) {
+			r.Use(h.WriteGuard, h.Identify)
+			r.Post("/", h.ShortenHandler)
+			r.Post("/api/shorten", h.ShortenJSONHandler)
+			r.Post("/api/shorten/batch", h.ShortenBatchHandler)
+			r.Post("/api/report", h.ReportHandler)
+		})
+
+		r.Get("/api/lookup", h.LookupHandler)
+		r.Post("/api/expand/batch", h.ExpandBatchHandler)
+
+		// anyone may inspect a link, only its owner or an admin may edit it
+		r.Group(func(r chi.Router) {
+			r.Use(h.Identify)
+			r.Get("/api/urls/{id}", h.URLInfoHandler)
+			r.Get("/api/urls/{id}/history", h.URLHistoryHandler)
+			r.With(h.WriteGuard).Patch("/api/urls/{id}", h.EditURLHandler)
+			r.With(h.WriteGuard).Post("/api/urls/{id}/rollback", h.RollbackURLHandler)
+		})
+
+		// variants and rules are only edited by admins
+		r.Group(func(r chi.Router) {
+			r.Use(h.AdminOnly)
+			r.Get("/api/urls/{id}/variants", h.GetVariantsHandler)
+			r.With(h.WriteGuard).Put("/api/urls/{id}/variants", h.SetVariantsHandler)
+			r.Get("/api/urls/{id}/rules", h.GetRulesHandler)
+			r.With(h.WriteGuard).Put("/api/urls/{id}/rules", h.SetRulesHandler)
+			r.Post("/api/urls/{id}/rules/test", h.TestRulesHandler)
+		})
+
+		r.Route("/api/admin", func(r chi.Router) {
+			r.Use(h.AdminOnly)
+			r.Get("/readonly", h.ReadOnlyStatusHandler)
+			r.Put("/readonly", h.SetReadOnlyHandler)
+			r.Post("/keys/rotate", h.RotateKeysHandler)
+			r.Get("/reports", h.ReportsHandler)
+			r.Get("/links/{id}/health", h.LinkHealthHandler)
+			r.Group(func(r chi.Router) {
+				r.Use(h.WriteGuard)
+				r.Post("/links/{id}/disable", h.DisableLinkHandler)
+				r.Post("/links/{id}/enable", h.EnableLinkHandler)
+				r.Post("/links/{id}/dismiss", h.DismissReportsHandler)
+			})
+		})
 	})
 
 	return r
 }
 
+// initAdminServer returns the server for /metrics, nil if it is disabled. It
+// listens on its own address so metrics are not exposed with the links.
+func initAdminServer(cfg *config.Config) *http.Server {
+	if cfg.MetricsAddr == "" {
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics.Handler())
+	return &http.Server{Addr: cfg.MetricsAddr, Handler: mux}
+}
+
+// serve runs the server until SIGINT or SIGTERM, then waits for in-flight
+// requests to finish.
+func serve(cfg *config.Config, st t.Storage) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	srv := &http.Server{Addr: cfg.ServerAddr, Handler: initRouter(cfg, st)}
+	adminSrv := initAdminServer(cfg)
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			logger.Log.Error("could not shut down server", zap.Error(err))
+		}
+		if adminSrv != nil {
+			if err := adminSrv.Shutdown(shutdownCtx); err != nil {
+				logger.Log.Error("could not shut down admin server", zap.Error(err))
+			}
+		}
+	}()
+
+	if adminSrv != nil {
+		go func() {
+			if err := adminSrv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				logger.Log.Error("admin server stopped", zap.Error(err))
+			}
+		}()
+	}
+
+	err := srv.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	// ListenAndServe returns as soon as Shutdown is called, wait for in-flight requests
+	<-shutdownDone
+	return nil
+}
+
 func main() {
 	cfg, err := initConfig()
 	if err != nil {
@@ -84,14 +293,30 @@ func main() {
 		log.Fatal(err)
 	}
 
+	err = initTemplates(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	shutdownTracing, err := initTracing(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	store, err := initStorage(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer closeStorage(store)
 
-	r := initRouter(cfg, store)
-	err = http.ListenAndServe(cfg.ServerAddr, r)
+	// storage is closed after the server stops, so memory snapshots include every request
+	err = serve(cfg, store)
+	closeStorage(store)
+	// spans of the last requests are flushed before exiting
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if err := shutdownTracing(ctx); err != nil {
+		logger.Log.Error("could not flush traces", zap.Error(err))
+	}
+	cancel()
 	if err != nil {
 		log.Fatal(err)
 	}
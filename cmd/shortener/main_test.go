@@ -3,19 +3,45 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
 	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
 	"github.com/repriest/url-shortener/internal/config"
 	"github.com/repriest/url-shortener/internal/handlers"
+	"github.com/repriest/url-shortener/internal/healthcheck"
+	"github.com/repriest/url-shortener/internal/keyring"
+	"github.com/repriest/url-shortener/internal/logger"
+	"github.com/repriest/url-shortener/internal/metrics"
+	"github.com/repriest/url-shortener/internal/storage/breaker"
+	"github.com/repriest/url-shortener/internal/storage/encrypted"
+	"github.com/repriest/url-shortener/internal/storage/file"
+	"github.com/repriest/url-shortener/internal/storage/instrumented"
 	"github.com/repriest/url-shortener/internal/storage/memory"
+	"github.com/repriest/url-shortener/internal/storage/types"
+	"github.com/repriest/url-shortener/internal/tracing"
+	"github.com/repriest/url-shortener/internal/urlservice"
 	"github.com/repriest/url-shortener/internal/zipper"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"image/png"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var cfg *config.Config
@@ -240,9 +266,10 @@ func TestGzipCompression(t *testing.T) {
 
 		r.ServeHTTP(rec, req)
 
+		// the URL was shortened by the previous request
 		resp := rec.Result()
 		resp.Body.Close()
-		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
 
 		zr, err := gzip.NewReader(resp.Body)
 		require.NoError(t, err)
@@ -329,3 +356,1395 @@ func TestShortenBatchHandler(t *testing.T) {
 		})
 	}
 }
+
+// failingStorage fails every write, as a backend with a dropped connection would
+type failingStorage struct {
+	types.Storage
+}
+
+func (s failingStorage) Append(_ context.Context, _ types.URLEntry) error {
+	return errors.New("connection refused")
+}
+
+func (s failingStorage) Ping(_ context.Context) error {
+	return nil
+}
+
+// clickFailingStorage serves reads but cannot count clicks, as with a
+// failing primary and healthy replicas
+type clickFailingStorage struct {
+	types.Storage
+}
+
+func (s clickFailingStorage) AddClick(_ context.Context, _, _ string) error {
+	return errors.New("connection refused")
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	b := breaker.NewBreaker(failingStorage{}, 2, time.Hour)
+	h := handlers.NewHandler(cfg, b)
+
+	shorten := func() *http.Response {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("https://google.com"))
+		rec := httptest.NewRecorder()
+		h.ShortenHandler(rec, req)
+		return rec.Result()
+	}
+
+	// failures reach the backend until the threshold is hit
+	for i := 0; i < 2; i++ {
+		resp := shorten()
+		resp.Body.Close()
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	}
+
+	// then requests fail fast
+	resp := shorten()
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, breaker.StateOpen, b.State())
+
+	req := httptest.NewRequest(http.MethodGet, "/ping", nil)
+	rec := httptest.NewRecorder()
+	h.PingHandler(rec, req)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "open", rec.Header().Get("X-Circuit-Breaker"))
+
+	// a stored link may be protected or disabled, so codes are not decoded
+	// while storage is down
+	r := chi.NewRouter()
+	r.Get("/{id}", h.ExpandHandler)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/aHR0cHM6Ly9nb29nbGUuY29t", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Empty(t, rec.Header().Get("Location"))
+
+	// failing clicks do not open the breaker
+	mem, err := memory.NewMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	require.NoError(t, mem.Append(context.Background(), types.URLEntry{UUID: "1", ShortURL: "abc", OriginalURL: "https://google.com"}))
+	b = breaker.NewBreaker(clickFailingStorage{mem}, 2, time.Hour)
+	r = chi.NewRouter()
+	r.Get("/{id}", handlers.NewHandler(cfg, b).ExpandHandler)
+	for i := 0; i < 3; i++ {
+		rec = httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/abc", nil))
+		assert.Equal(t, http.StatusTemporaryRedirect, rec.Code)
+	}
+	assert.Equal(t, breaker.StateClosed, b.State())
+}
+
+func TestReadOnlyMode(t *testing.T) {
+	st, err := memory.NewMemoryStorage()
+	require.NoError(t, err)
+	defer st.Close()
+	adminCfg := *cfg
+	adminCfg.AdminToken = "secret"
+	r := initRouter(&adminCfg, st)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodPut, "/api/admin/readonly", `{"enabled":true}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"read_only":true,"reason":"planned maintenance","retry_after":30}`, rec.Body.String())
+
+	// shortening is refused, redirects keep working
+	rec = do(http.MethodPost, "/", "https://google.com")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "30", rec.Header().Get("Retry-After"))
+	rec = do(http.MethodGet, "/aHR0cHM6Ly9nb29nbGUuY29t", "")
+	assert.Equal(t, http.StatusTemporaryRedirect, rec.Code)
+
+	rec = do(http.MethodPut, "/api/admin/readonly", `{"enabled":false}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = do(http.MethodPost, "/", "https://google.com")
+	assert.Equal(t, http.StatusCreated, rec.Code)
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	const (
+		key1    = "k1:MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+		key2    = "k2:ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA="
+		hashKey = "aGFzaGtleWhhc2hrZXloYXNoa2V5aGFzaGtleWhhc2g="
+	)
+	mem, err := memory.NewMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+
+	kr, err := keyring.New([]string{key1}, "k1", hashKey)
+	require.NoError(t, err)
+	es := encrypted.NewEncryptedStorage(mem, kr)
+
+	entry := types.URLEntry{UUID: "1", ShortURL: "aHR0cHM6Ly9nb29nbGUuY29t", OriginalURL: "https://google.com"}
+	require.NoError(t, es.Append(context.Background(), entry))
+
+	// backend only sees ciphertext
+	raw, err := mem.Load(context.Background())
+	require.NoError(t, err)
+	require.Len(t, raw, 1)
+	assert.Equal(t, "k1", raw[0].KeyID)
+	assert.NotContains(t, raw[0].OriginalURL, "google")
+	assert.Equal(t, kr.Hash("https://google.com"), raw[0].URLHash)
+
+	// rotate to a new active key, the old one is kept for decryption
+	kr, err = keyring.New([]string{key1, key2}, "k2", hashKey)
+	require.NoError(t, err)
+	es = encrypted.NewEncryptedStorage(mem, kr)
+	rotated, err := es.Rotate(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, rotated)
+
+	raw, err = mem.Load(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "k2", raw[0].KeyID)
+
+	entries, err := es.Load(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "https://google.com", entries[0].OriginalURL)
+
+	// revisions are encrypted too
+	entry = entries[0]
+	entry.OriginalURL = "https://google.com/new"
+	rev, err := es.Revise(context.Background(), entry, types.Revision{Old: entries[0].Version(), New: entry.Version()})
+	require.NoError(t, err)
+	assert.Equal(t, "https://google.com/new", rev.New.OriginalURL)
+	rawRevs, err := mem.Revisions(context.Background(), entry.ShortURL)
+	require.NoError(t, err)
+	assert.NotContains(t, rawRevs[0].New.OriginalURL, "google")
+	revs, err := es.Revisions(context.Background(), entry.ShortURL)
+	require.NoError(t, err)
+	assert.Equal(t, "https://google.com", revs[0].Old.OriginalURL)
+	assert.Equal(t, "https://google.com/new", revs[0].New.OriginalURL)
+
+	// codes of new links do not encode the URL
+	r := initRouter(cfg, es)
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("https://ya.ru"))
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	code := strings.TrimPrefix(rec.Body.String(), cfg.BaseURL+"/")
+	assert.Equal(t, kr.Code("https://ya.ru"), code)
+	_, err = urlservice.ExpandURL(code)
+	assert.Error(t, err)
+	req = httptest.NewRequest(http.MethodGet, "/"+code, nil)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusTemporaryRedirect, rec.Code)
+	assert.Equal(t, "https://ya.ru", rec.Header().Get("Location"))
+
+	// links from before encryption get the keyed hash, so they are found as
+	// duplicates
+	legacy, err := memory.NewMemoryStorage()
+	require.NoError(t, err)
+	defer legacy.Close()
+	require.NoError(t, legacy.Append(context.Background(), types.URLEntry{UUID: "1", ShortURL: "aHR0cHM6Ly9nb29nbGUuY29t", OriginalURL: "https://google.com"}))
+	es = encrypted.NewEncryptedStorage(legacy, kr)
+	migrated, err := es.MigrateHashes(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, migrated)
+	migrated, err = es.MigrateHashes(context.Background())
+	require.NoError(t, err)
+	assert.Zero(t, migrated)
+	found, err := es.FindByURLHash(context.Background(), es.HashURL("https://google.com"))
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	assert.Equal(t, "aHR0cHM6Ly9nb29nbGUuY29t", found[0].ShortURL)
+	assert.Equal(t, "https://google.com", found[0].OriginalURL)
+}
+
+func TestEncryptedStorageChain(t *testing.T) {
+	encCfg := *cfg
+	encCfg.FileStoragePath = t.TempDir() + "/urls.json"
+	encCfg.EncryptionKeys = []string{"k1:MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="}
+	encCfg.EncryptionActiveKey = "k1"
+	encCfg.URLHashKey = "aGFzaGtleWhhc2hrZXloYXNoa2V5aGFzaGtleWhhc2g="
+	encCfg.AdminToken = "secret"
+	encCfg.LinkCookieSecret = "cookie secret"
+	st, err := initStorage(&encCfg)
+	require.NoError(t, err)
+	defer st.Close()
+	r := initRouter(&encCfg, st)
+
+	do := func(method, path, body string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodPost, "/", "https://example.com/old")
+	require.Equal(t, http.StatusCreated, rec.Code)
+	code := strings.TrimPrefix(rec.Body.String(), cfg.BaseURL+"/")
+	cookies := rec.Result().Cookies()
+
+	// revisions and reports reach the backend through every wrapper
+	rec = do(http.MethodPatch, "/api/urls/"+code, `{"url":"https://example.com/new"}`, cookies...)
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = do(http.MethodGet, "/api/urls/"+code+"/history", "", cookies...)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var revisions []types.Revision
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &revisions))
+	require.Len(t, revisions, 1)
+	assert.Equal(t, "https://example.com/new", revisions[0].New.OriginalURL)
+	rec = do(http.MethodPost, "/api/urls/"+code+"/rollback", `{"version":0}`, cookies...)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = do(http.MethodGet, "/"+code, "")
+	assert.Equal(t, http.StatusTemporaryRedirect, rec.Code)
+	assert.Equal(t, "https://example.com/old", rec.Header().Get("Location"))
+
+	rec = do(http.MethodPost, "/api/report", `{"url":"`+code+`","reason":"spam"}`)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	rec = do(http.MethodGet, "/api/admin/reports", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), code)
+}
+
+func TestRedirectOptions(t *testing.T) {
+	st, err := memory.NewMemoryStorage()
+	require.NoError(t, err)
+	defer st.Close()
+	r := initRouter(cfg, st)
+
+	tt := []struct {
+		name         string
+		body         string
+		path         string
+		statusCode   int
+		cacheControl string
+	}{
+		{
+			name:         "Default",
+			body:         `{"url":"https://google.com"}`,
+			path:         "/aHR0cHM6Ly9nb29nbGUuY29t",
+			statusCode:   http.StatusTemporaryRedirect,
+			cacheControl: "private, no-cache",
+		},
+		{
+			name:         "Permanent",
+			body:         `{"url":"https://ya.ru","redirect_code":301}`,
+			path:         "/aHR0cHM6Ly95YS5ydQ==",
+			statusCode:   http.StatusMovedPermanently,
+			cacheControl: "public, max-age=86400",
+		},
+		{
+			name:         "PermanentTracked",
+			body:         `{"url":"https://go.dev","redirect_code":308,"tracked":true}`,
+			path:         "/aHR0cHM6Ly9nby5kZXY=",
+			statusCode:   http.StatusPermanentRedirect,
+			cacheControl: "no-store",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(tc.body))
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			require.Equal(t, http.StatusCreated, rec.Code)
+
+			for _, method := range []string{http.MethodGet, http.MethodHead} {
+				req := httptest.NewRequest(method, tc.path, nil)
+				rec := httptest.NewRecorder()
+				r.ServeHTTP(rec, req)
+				assert.Equal(t, tc.statusCode, rec.Code)
+				assert.Equal(t, tc.cacheControl, rec.Header().Get("Cache-Control"))
+			}
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{"url":"https://google.com","redirect_code":200}`))
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestForwarding(t *testing.T) {
+	st, err := memory.NewMemoryStorage()
+	require.NoError(t, err)
+	defer st.Close()
+	r := initRouter(cfg, st)
+
+	body := `{"url":"https://example.com/docs?lang=en","forward_query":true,"forward_path":true}`
+	req := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	code := "/aHR0cHM6Ly9leGFtcGxlLmNvbS9kb2NzP2xhbmc9ZW4="
+
+	tt := []struct {
+		name       string
+		path       string
+		statusCode int
+		location   string
+	}{
+		{"NoSuffix", code, http.StatusTemporaryRedirect, "https://example.com/docs?lang=en"},
+		{"Query", code + "?utm_source=mail&lang=de", http.StatusTemporaryRedirect, "https://example.com/docs?lang=en&utm_source=mail"},
+		{"Suffix", code + "/a%20b/c?x=1", http.StatusTemporaryRedirect, "https://example.com/docs/a%20b/c?lang=en&x=1"},
+		{"DotSegment", code + "/../admin", http.StatusBadRequest, ""},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			assert.Equal(t, tc.statusCode, rec.Code)
+			assert.Equal(t, tc.location, rec.Header().Get("Location"))
+		})
+	}
+
+	// links without forward_path do not accept suffixes
+	req = httptest.NewRequest(http.MethodGet, "/aHR0cHM6Ly9nb29nbGUuY29t/extra", nil)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestVariants(t *testing.T) {
+	st, err := memory.NewMemoryStorage()
+	require.NoError(t, err)
+	defer st.Close()
+	adminCfg := *cfg
+	adminCfg.AdminToken = "secret"
+	r := initRouter(&adminCfg, st)
+
+	do := func(method, path, body string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodPost, "/", "https://google.com")
+	require.Equal(t, http.StatusCreated, rec.Code)
+	code := "aHR0cHM6Ly9nb29nbGUuY29t"
+
+	rec = do(http.MethodPut, "/api/urls/"+code+"/variants", `{"variants":[{"id":"a","url":"https://a.example","weight":0}]}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = do(http.MethodPut, "/api/urls/"+code+"/variants", `{"variants":[{"id":"a","url":"https://a.example","weight":9223372036854775807}]}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	variants := `{"sticky":true,"variants":[{"id":"a","url":"https://a.example","weight":1},{"id":"b","url":"https://b.example","weight":3}]}`
+	rec = do(http.MethodPut, "/api/urls/"+code+"/variants", variants)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, variants, rec.Body.String())
+
+	// first visit picks a variant and remembers it
+	rec = do(http.MethodGet, "/"+code, "")
+	assert.Equal(t, http.StatusTemporaryRedirect, rec.Code)
+	assert.Contains(t, []string{"https://a.example", "https://b.example"}, rec.Header().Get("Location"))
+	assert.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+	cookies := rec.Result().Cookies()
+	require.Len(t, cookies, 1)
+
+	// sticky visitors keep their variant
+	cookies[0].Value = "a"
+	for i := 0; i < 5; i++ {
+		rec = do(http.MethodGet, "/"+code, "", cookies[0])
+		assert.Equal(t, "https://a.example", rec.Header().Get("Location"))
+	}
+
+	// clicks are counted per variant
+	rec = do(http.MethodGet, "/api/urls/"+code, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var info handlers.URLInfoResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &info))
+	assert.Equal(t, int64(6), info.Clicks)
+	assert.Equal(t, info.Clicks, info.VariantClicks["a"]+info.VariantClicks["b"])
+	assert.GreaterOrEqual(t, info.VariantClicks["a"], int64(5))
+
+	// shortening the URL again keeps the variants
+	rec = do(http.MethodPost, "/", "https://google.com")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	rec = do(http.MethodGet, "/api/urls/"+code+"/variants", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, variants, rec.Body.String())
+
+	rec = do(http.MethodPut, "/api/urls/bm90Zm91bmQ=/variants", variants)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestRules(t *testing.T) {
+	st, err := memory.NewMemoryStorage()
+	require.NoError(t, err)
+	defer st.Close()
+	adminCfg := *cfg
+	adminCfg.AdminToken = "secret"
+	r := initRouter(&adminCfg, st)
+
+	do := func(method, path, body string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodPost, "/", "https://google.com", nil)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	code := "aHR0cHM6Ly9nb29nbGUuY29t"
+
+	rec = do(http.MethodPut, "/api/urls/"+code+"/rules", `{"rules":[{"devices":["fridge"],"destination":"https://a.example"}]}`, nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rules := `{"rules":[
+		{"id":"mobile-de","devices":["mobile"],"languages":["de"],"destination":"https://de.m.example"},
+		{"id":"us","countries":["US"],"destination":"https://us.example"}
+	]}`
+	rec = do(http.MethodPut, "/api/urls/"+code+"/rules", rules, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	iphone := "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) Mobile/15E148"
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   string
+	}{
+		{"mobile german", map[string]string{"User-Agent": iphone, "Accept-Language": "de-DE,en;q=0.5"}, "https://de.m.example"},
+		{"mobile english", map[string]string{"User-Agent": iphone, "Accept-Language": "en"}, "https://google.com"},
+		{"country", map[string]string{"X-Country-Code": "US"}, "https://us.example"},
+		{"no match", nil, "https://google.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := do(http.MethodGet, "/"+code, "", tt.header)
+			assert.Equal(t, http.StatusTemporaryRedirect, rec.Code)
+			assert.Equal(t, tt.want, rec.Header().Get("Location"))
+			assert.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+		})
+	}
+
+	// dry run reports the rule without redirecting
+	rec = do(http.MethodPost, "/api/urls/"+code+"/rules/test", `{"headers":{"x-country-code":"US"}}`, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"rule":1,"rule_id":"us","destination":"https://us.example","device":"desktop","country":"US"}`, rec.Body.String())
+
+	rec = do(http.MethodPost, "/api/urls/"+code+"/rules/test", `{"headers":{}}`, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"rule":-1,"destination":"https://google.com","device":"desktop"}`, rec.Body.String())
+}
+
+func TestAppLinks(t *testing.T) {
+	st, err := memory.NewMemoryStorage()
+	require.NoError(t, err)
+	defer st.Close()
+	r := initRouter(cfg, st)
+
+	body := `{"url":"https://shop.example","app_link":{"ios_url":"shop://item/1","ios_store_url":"https://apps.apple.com/app/id1","android_url":"https://shop.example/app/item/1"}}`
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(body)))
+	require.Equal(t, http.StatusCreated, rec.Code)
+	code := "aHR0cHM6Ly9zaG9wLmV4YW1wbGU="
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{"url":"https://x.example","app_link":{"ios_url":"javascript:alert(1)"}}`)))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	expand := func(userAgent string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/"+code, nil)
+		req.Header.Set("User-Agent", userAgent)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// custom schemes get a page falling back to the store
+	rec = expand("Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) Mobile/15E148")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `href="shop://item/1"`)
+	assert.Contains(t, rec.Body.String(), "https://apps.apple.com/app/id1")
+	assert.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+
+	// app links are plain redirects
+	rec = expand("Mozilla/5.0 (Linux; Android 14; Pixel 8) Mobile Safari/537.36")
+	assert.Equal(t, http.StatusTemporaryRedirect, rec.Code)
+	assert.Equal(t, "https://shop.example/app/item/1", rec.Header().Get("Location"))
+
+	rec = expand("Mozilla/5.0 (X11; Linux x86_64) Firefox/120.0")
+	assert.Equal(t, http.StatusTemporaryRedirect, rec.Code)
+	assert.Equal(t, "https://shop.example", rec.Header().Get("Location"))
+
+	// association files are generated from config
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/.well-known/assetlinks.json", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	appCfg := *cfg
+	appCfg.AppleAppIDs = []string{"TEAM.com.example.shop"}
+	appCfg.AndroidPackage = "com.example.shop"
+	appCfg.AndroidCertFingerprints = []string{"AB:CD"}
+	r = initRouter(&appCfg, st)
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/.well-known/apple-app-site-association", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"applinks":{"apps":[],"details":[{"appID":"TEAM.com.example.shop","paths":["NOT /api/*","NOT /ping","*"]}]}}`, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/.well-known/assetlinks.json", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `[{"relation":["delegate_permission/common.handle_all_urls"],"target":{"namespace":"android_app","package_name":"com.example.shop","sha256_cert_fingerprints":["AB:CD"]}}]`, rec.Body.String())
+}
+
+func TestPasswordProtectedLinks(t *testing.T) {
+	st, err := memory.NewMemoryStorage()
+	require.NoError(t, err)
+	defer st.Close()
+	pwCfg := *cfg
+	pwCfg.PasswordMaxAttempts = 2
+	r := initRouter(&pwCfg, st)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{"url":"https://secret.example","password":"hunter2"}`)))
+	require.Equal(t, http.StatusCreated, rec.Code)
+	var resp handlers.ShortenResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	code := strings.TrimPrefix(resp.Result, pwCfg.BaseURL+"/")
+
+	// the code does not reveal the destination, nor does looking it up
+	_, err = urlservice.ExpandURL(code)
+	assert.Error(t, err)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/lookup?url="+url.QueryEscape("https://secret.example"), nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("https://secret.example")))
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.NotContains(t, rec.Body.String(), code)
+
+	unlock := func(password, ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/"+code+"?ref=mail", strings.NewReader("password="+password))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = ip + ":1234"
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// the link shows a form instead of redirecting
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+code, nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `name="password"`)
+	assert.Empty(t, rec.Header().Get("Location"))
+
+	rec = unlock("wrong", "10.0.0.1")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec = unlock("wrong", "10.0.0.1")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	// locked out even with the right password, other IPs are not affected
+	rec = unlock("hunter2", "10.0.0.1")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+
+	rec = unlock("hunter2", "10.0.0.2")
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	assert.Equal(t, "/"+code+"?ref=mail", rec.Header().Get("Location"))
+	cookies := rec.Result().Cookies()
+	require.Len(t, cookies, 1)
+
+	req := httptest.NewRequest(http.MethodGet, "/"+code, nil)
+	req.AddCookie(cookies[0])
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusTemporaryRedirect, rec.Code)
+	assert.Equal(t, "https://secret.example", rec.Header().Get("Location"))
+
+	// tampered cookies are rejected
+	cookies[0].Value = "9999999999" + cookies[0].Value[strings.Index(cookies[0].Value, "."):]
+	req = httptest.NewRequest(http.MethodGet, "/"+code, nil)
+	req.AddCookie(cookies[0])
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// the preview of the link can be unlocked too
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+code+"+", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `name="password"`)
+	req = httptest.NewRequest(http.MethodPost, "/"+code+"+", strings.NewReader("password=hunter2"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.RemoteAddr = "10.0.0.3:1234"
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	assert.Equal(t, "/"+code+"+", rec.Header().Get("Location"))
+	cookies = rec.Result().Cookies()
+	require.Len(t, cookies, 1)
+	req = httptest.NewRequest(http.MethodGet, "/"+code+"+", nil)
+	req.AddCookie(cookies[0])
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "secret.example")
+}
+
+func TestPreview(t *testing.T) {
+	st, err := memory.NewMemoryStorage()
+	require.NoError(t, err)
+	defer st.Close()
+	r := initRouter(cfg, st)
+
+	shorten := func(body string) {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(body)))
+		require.Equal(t, http.StatusCreated, rec.Code)
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	shorten(`{"url":"https://google.com"}`)
+	rec := get("/aHR0cHM6Ly9nb29nbGUuY29t+")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `href="https://google.com"`)
+	assert.Contains(t, rec.Body.String(), "Created "+time.Now().UTC().Format("2 Jan 2006"))
+	assert.NotContains(t, rec.Body.String(), "Clicks:")
+	assert.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+
+	rec = get("/aHR0cHM6Ly9nb29nbGUuY29t")
+	assert.Equal(t, http.StatusTemporaryRedirect, rec.Code)
+
+	// previews are not counted, but show the count
+	rec = get("/aHR0cHM6Ly9nb29nbGUuY29t+")
+	assert.Contains(t, rec.Body.String(), "Clicks: 1")
+
+	// stored codes ending with "+" still redirect
+	shorten(`{"url":"https://a.io/a~"}`)
+	rec = get("/aHR0cHM6Ly9hLmlvL2F+")
+	assert.Equal(t, http.StatusTemporaryRedirect, rec.Code)
+	assert.Equal(t, "https://a.io/a~", rec.Header().Get("Location"))
+
+	// interstitial links always show the preview
+	shorten(`{"url":"https://example.com","interstitial":true}`)
+	rec = get("/aHR0cHM6Ly9leGFtcGxlLmNvbQ==")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "example.com")
+
+	// templates can be overridden from a directory
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(dir+"/preview.html", []byte("custom {{.Destination}}"), 0o644))
+	require.NoError(t, handlers.LoadTemplates(dir))
+	defer handlers.LoadTemplates("")
+	rec = get("/aHR0cHM6Ly9leGFtcGxlLmNvbQ==")
+	assert.Equal(t, "custom https://example.com", rec.Body.String())
+}
+
+func TestURLPolicy(t *testing.T) {
+	st, err := memory.NewMemoryStorage()
+	require.NoError(t, err)
+	defer st.Close()
+	r := initRouter(cfg, st)
+
+	post := func(path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("X-Request-ID", "policy-test")
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := post("/", "javascript:alert(1)")
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	assert.JSONEq(t, `{"errors":[{"code":"scheme_not_allowed","message":"scheme \"javascript\" is not allowed","url":"javascript:alert(1)"}],"request_id":"policy-test"}`, rec.Body.String())
+
+	rec = post("/api/shorten", `{"url":"`+cfg.BaseURL+`/abc"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"code":"self_reference"`)
+
+	// unparsable URLs are still bad requests
+	rec = post("/api/shorten", `{"url":"not a url"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// batches report every rejected URL and store nothing
+	rec = post("/api/shorten/batch", `[
+		{"correlation_id":"1","original_url":"https://example.com"},
+		{"correlation_id":"2","original_url":"http://127.0.0.1/admin"},
+		{"correlation_id":"3","original_url":"file:///etc/passwd"}
+	]`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	var resp handlers.URLErrorResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.Len(t, resp.Errors, 2)
+	assert.Equal(t, "2", resp.Errors[0].CorrelationID)
+	assert.Equal(t, "private_host", resp.Errors[0].Code)
+	assert.Equal(t, "3", resp.Errors[1].CorrelationID)
+
+	entries, err := st.Load(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// decoded codes are checked like shortened URLs
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/aHR0cDovLzEyNy4wLjAuMS9hZG1pbg==", nil))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Empty(t, rec.Header().Get("Location"))
+
+	// so are variant and rule destinations
+	rec = post("/api/shorten", `{"url":"https://example.com"}`)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	adminCfg := *cfg
+	adminCfg.AdminToken = "secret"
+	admin := initRouter(&adminCfg, st)
+	put := func(path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPut, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		admin.ServeHTTP(rec, req)
+		return rec
+	}
+	code := "aHR0cHM6Ly9leGFtcGxlLmNvbQ=="
+	rec = put("/api/urls/"+code+"/variants", `{"variants":[{"id":"a","url":"https://a.example","weight":1},{"id":"b","url":"http://10.0.0.1/","weight":1}]}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"code":"private_host"`)
+	rec = put("/api/urls/"+code+"/rules", `{"rules":[{"countries":["US"],"destination":"`+cfg.BaseURL+`/abc"}]}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"code":"self_reference"`)
+	rec = put("/api/urls/"+code+"/variants", `{"variants":[{"id":"a","url":"https://a.example","weight":1}]}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestCanonicalURLs(t *testing.T) {
+	st, err := memory.NewMemoryStorage()
+	require.NoError(t, err)
+	defer st.Close()
+	canonicalCfg := *cfg
+	canonicalCfg.CanonicalSortQuery = true
+	canonicalCfg.CanonicalStripTracking = true
+	r := initRouter(&canonicalCfg, st)
+
+	// equivalent URLs are duplicates of the first one
+	shorten := func(url string) string {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(url)))
+		require.Contains(t, []int{http.StatusCreated, http.StatusConflict}, rec.Code)
+		return rec.Body.String()
+	}
+
+	want := shorten("http://example.com/a?a=1&b=2")
+	assert.Equal(t, want, shorten("HTTP://Example.com:80/a?b=2&a=1"))
+	assert.Equal(t, want, shorten("http://example.com/a?b=2&utm_source=mail&a=1"))
+	assert.Equal(t, cfg.BaseURL+"/aHR0cHM6Ly9nb29nbGUuY29t", shorten("https://google.com"))
+}
+
+func TestBlocklist(t *testing.T) {
+	st, err := memory.NewMemoryStorage()
+	require.NoError(t, err)
+	defer st.Close()
+	domains := t.TempDir() + "/domains.txt"
+	require.NoError(t, os.WriteFile(domains, []byte("phish.example\n"), 0o644))
+	blockCfg := *cfg
+	blockCfg.BlocklistDomainsPath = domains
+	blockCfg.BlocklistReloadInterval = time.Nanosecond
+	r := initRouter(&blockCfg, st)
+
+	post := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(url)))
+		return rec
+	}
+
+	rec := post("https://login.phish.example/")
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"code":"blocked"`)
+
+	rec = post("https://shop.example")
+	require.Equal(t, http.StatusCreated, rec.Code)
+	code := strings.TrimPrefix(rec.Body.String(), cfg.BaseURL+"/")
+
+	// links are disabled once their destination is blocked
+	require.NoError(t, os.WriteFile(domains, []byte("phish.example\nshop.example\n"), 0o644))
+	require.NoError(t, os.Chtimes(domains, time.Now(), time.Now().Add(time.Minute)))
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+code, nil))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Contains(t, rec.Body.String(), "disabled")
+	assert.Empty(t, rec.Header().Get("Location"))
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/expand/batch", strings.NewReader(`["`+code+`"]`)))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `[{"short_url":"`+code+`","status":"blocked"}]`, rec.Body.String())
+}
+
+func TestModeration(t *testing.T) {
+	path := t.TempDir() + "/urls.json"
+	st, err := file.NewFileStorage(path)
+	require.NoError(t, err)
+	adminCfg := *cfg
+	adminCfg.AdminToken = "secret"
+	r := initRouter(&adminCfg, st)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodPost, "/", "https://google.com")
+	require.Equal(t, http.StatusCreated, rec.Code)
+	code := "aHR0cHM6Ly9nb29nbGUuY29t"
+
+	rec = do(http.MethodPost, "/api/report", `{"url":"`+cfg.BaseURL+`/`+code+`","reason":"phishing","comment":"fake login"}`)
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	rec = do(http.MethodPost, "/api/report", `{"url":"`+code+`","reason":"bored"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = do(http.MethodPost, "/api/report", `{"url":"bm90Zm91bmQ=","reason":"spam"}`)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = do(http.MethodGet, "/api/admin/reports", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var reports []types.Report
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &reports))
+	require.Len(t, reports, 1)
+	assert.Equal(t, code, reports[0].ShortURL)
+	assert.Equal(t, "fake login", reports[0].Comment)
+	assert.Equal(t, types.ReportOpen, reports[0].Status)
+
+	rec = do(http.MethodPost, "/api/admin/links/"+code+"/disable", `{"reason":"confirmed phishing"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"short_url":"`+code+`","disabled":true,"resolved":1}`, rec.Body.String())
+
+	rec = do(http.MethodGet, "/"+code, "")
+	assert.Equal(t, http.StatusUnavailableForLegalReasons, rec.Code)
+	assert.Empty(t, rec.Header().Get("Location"))
+
+	// shortening the URL again does not bring the link back
+	rec = do(http.MethodPost, "/", "https://google.com")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Equal(t, cfg.BaseURL+"/"+code, rec.Body.String())
+	rec = do(http.MethodPost, "/api/shorten/batch", `[{"correlation_id":"1","original_url":"https://google.com"}]`)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	rec = do(http.MethodGet, "/"+code, "")
+	assert.Equal(t, http.StatusUnavailableForLegalReasons, rec.Code)
+
+	// disabled status and reports survive a restart
+	require.NoError(t, st.Close())
+	st, err = file.NewFileStorage(path)
+	require.NoError(t, err)
+	defer st.Close()
+	r = initRouter(&adminCfg, st)
+
+	rec = do(http.MethodGet, "/"+code, "")
+	assert.Equal(t, http.StatusUnavailableForLegalReasons, rec.Code)
+	rec = do(http.MethodGet, "/api/admin/reports", "")
+	assert.JSONEq(t, `[]`, rec.Body.String())
+	rec = do(http.MethodGet, "/api/admin/reports?status=actioned", "")
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &reports))
+	assert.Len(t, reports, 1)
+
+	rec = do(http.MethodPost, "/api/admin/links/"+code+"/enable", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = do(http.MethodPost, "/api/report", `{"url":"`+code+`","reason":"spam"}`)
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	rec = do(http.MethodPost, "/api/admin/links/"+code+"/dismiss", "")
+	assert.JSONEq(t, `{"short_url":"`+code+`","disabled":false,"resolved":1}`, rec.Body.String())
+
+	rec = do(http.MethodGet, "/"+code, "")
+	assert.Equal(t, http.StatusTemporaryRedirect, rec.Code)
+}
+
+func TestLinkHealth(t *testing.T) {
+	dest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer dest.Close()
+
+	st, err := memory.NewMemoryStorage()
+	require.NoError(t, err)
+	c := healthcheck.NewChecker(st, healthcheck.Options{FailureThreshold: 1, HistorySize: 5, Client: dest.Client()})
+	defer c.Close()
+	adminCfg := *cfg
+	adminCfg.AdminToken = "secret"
+	adminCfg.AllowPrivateHosts = true
+	r := initRouter(&adminCfg, c)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodPost, "/api/shorten", `{"url":"`+dest.URL+`","fallback_url":"ftp://example.com"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = do(http.MethodPost, "/api/shorten", `{"url":"`+dest.URL+`","fallback_url":"https://status.example.com/down"}`)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	var resp handlers.ShortenResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	code := strings.TrimPrefix(resp.Result, cfg.BaseURL+"/")
+
+	rec = do(http.MethodGet, "/"+code, "")
+	assert.Equal(t, dest.URL, rec.Header().Get("Location"))
+
+	require.NoError(t, c.CheckAll(context.Background()))
+	rec = do(http.MethodGet, "/api/admin/links/"+code+"/health", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var health handlers.LinkHealthResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &health))
+	assert.True(t, health.FailedOver)
+	assert.Equal(t, 1, health.ConsecutiveFailures)
+	require.Len(t, health.Results, 1)
+	assert.Equal(t, http.StatusServiceUnavailable, health.Results[0].Status)
+
+	rec = do(http.MethodGet, "/"+code, "")
+	assert.Equal(t, "https://status.example.com/down", rec.Header().Get("Location"))
+	assert.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+
+	// without a checker the endpoint is unavailable
+	r = initRouter(&adminCfg, st)
+	rec = do(http.MethodGet, "/api/admin/links/"+code+"/health", "")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+}
+
+func TestEditURL(t *testing.T) {
+	path := t.TempDir() + "/urls.json"
+	st, err := file.NewFileStorage(path)
+	require.NoError(t, err)
+	adminCfg := *cfg
+	adminCfg.AdminToken = "secret"
+	adminCfg.LinkCookieSecret = "cookie secret"
+	r := initRouter(&adminCfg, st)
+
+	var owner *http.Cookie
+	do := func(method, path, body string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodPost, "/api/shorten", `{"url":"https://example.com/old"}`, nil)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == "user_id" {
+			owner = c
+		}
+	}
+	require.NotNil(t, owner)
+	code := "aHR0cHM6Ly9leGFtcGxlLmNvbS9vbGQ="
+
+	rec = do(http.MethodPatch, "/api/urls/"+code, `{"url":"https://example.com/new"}`, nil)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	forged := *owner
+	forged.Value = strings.Split(owner.Value, ".")[0] + ".forged"
+	rec = do(http.MethodPatch, "/api/urls/"+code, `{"url":"https://example.com/new"}`, &forged)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec = do(http.MethodPatch, "/api/urls/"+code, `{"redirect_code":404}`, owner)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = do(http.MethodPatch, "/api/urls/"+code, `{}`, owner)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = do(http.MethodPatch, "/api/urls/"+code, `{"url":"https://example.com/new","redirect_code":301}`, owner)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var rev types.Revision
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &rev))
+	assert.Equal(t, 1, rev.Version)
+	assert.Equal(t, "https://example.com/old", rev.Old.OriginalURL)
+	assert.Equal(t, "https://example.com/new", rev.New.OriginalURL)
+
+	rec = do(http.MethodGet, "/"+code, "", nil)
+	assert.Equal(t, http.StatusMovedPermanently, rec.Code)
+	assert.Equal(t, "https://example.com/new", rec.Header().Get("Location"))
+
+	// shortening the old URL again does not take over the edited link
+	rec = do(http.MethodPost, "/", "https://example.com/old", nil)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	other := strings.TrimPrefix(rec.Body.String(), cfg.BaseURL+"/")
+	assert.NotEqual(t, code, other)
+	rec = do(http.MethodGet, "/"+other, "", nil)
+	assert.Equal(t, "https://example.com/old", rec.Header().Get("Location"))
+	rec = do(http.MethodGet, "/"+code, "", nil)
+	assert.Equal(t, "https://example.com/new", rec.Header().Get("Location"))
+	rec = do(http.MethodGet, "/api/urls/"+code+"/history", "", owner)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = do(http.MethodPost, "/api/shorten/batch", `[{"correlation_id":"1","original_url":"https://example.com/old"}]`, nil)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	assert.NotContains(t, rec.Body.String(), code)
+
+	rec = do(http.MethodPatch, "/api/urls/"+code, `{"metadata":{"campaign":"spring"}}`, owner)
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = do(http.MethodPatch, "/api/urls/"+code, `{"metadata":{"campaign":"spring"}}`, owner)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+
+	// admins may edit any link
+	req := httptest.NewRequest(http.MethodPatch, "/api/urls/"+code, strings.NewReader(`{"redirect_code":308}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &rev))
+	assert.Equal(t, "admin", rev.Author)
+
+	rec = do(http.MethodPost, "/api/urls/"+code+"/rollback", `{"version":9}`, owner)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = do(http.MethodPost, "/api/urls/"+code+"/rollback", `{"version":0}`, owner)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &rev))
+	assert.Equal(t, 4, rev.Version)
+
+	rec = do(http.MethodGet, "/"+code, "", nil)
+	assert.Equal(t, http.StatusTemporaryRedirect, rec.Code)
+	assert.Equal(t, "https://example.com/old", rec.Header().Get("Location"))
+
+	// history survives a restart
+	require.NoError(t, st.Close())
+	st, err = file.NewFileStorage(path)
+	require.NoError(t, err)
+	defer st.Close()
+	r = initRouter(&adminCfg, st)
+
+	rec = do(http.MethodGet, "/api/urls/"+code+"/history", "", owner)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var history []types.Revision
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &history))
+	require.Len(t, history, 4)
+	assert.Equal(t, map[string]string{"campaign": "spring"}, history[1].New.Metadata)
+	assert.Equal(t, owner.Value[:strings.Index(owner.Value, ".")], history[0].Author)
+	assert.Equal(t, history[0].Old, history[3].New)
+
+	// edited links are found by their new URL, also when storage returns the
+	// hash of the old one like the database does
+	mem, err := memory.NewMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	require.NoError(t, mem.Append(context.Background(), types.URLEntry{
+		UUID: "1", ShortURL: code, OriginalURL: "https://example.com/old", URLHash: types.HashURL("https://example.com/old"),
+	}))
+	r = initRouter(&adminCfg, mem)
+	req = httptest.NewRequest(http.MethodPatch, "/api/urls/"+code, strings.NewReader(`{"url":"https://example.com/new"}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = do(http.MethodGet, "/api/lookup?url="+url.QueryEscape("https://example.com/new"), "", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"short_code":"`+code+`"`)
+	rec = do(http.MethodGet, "/api/lookup?url="+url.QueryEscape("https://example.com/old"), "", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestLookupAndInfo(t *testing.T) {
+	st, err := memory.NewMemoryStorage()
+	require.NoError(t, err)
+	defer st.Close()
+	r := initRouter(cfg, st)
+
+	do := func(method, path, body string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodPost, "/api/shorten", `{"url":"https://example.com/a","redirect_code":301,"metadata":{"team":"web"}}`, nil)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	cookies := rec.Result().Cookies()
+	require.Len(t, cookies, 1)
+	owner := cookies[0]
+	code := "aHR0cHM6Ly9leGFtcGxlLmNvbS9h"
+	rec = do(http.MethodPost, "/api/shorten", `{"url":"https://example.com/secret","password":"hunter2"}`, nil)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	var protected handlers.ShortenResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &protected))
+
+	// the URL is canonicalized before the lookup
+	rec = do(http.MethodGet, "/api/lookup?url="+url.QueryEscape("HTTPS://Example.com:443/a"), "", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"url":"https://example.com/a","links":[{"short_code":"`+code+`","short_url":"`+cfg.BaseURL+`/`+code+`"}]}`, rec.Body.String())
+	rec = do(http.MethodGet, "/api/lookup?url="+url.QueryEscape("https://example.com/b"), "", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = do(http.MethodGet, "/api/lookup", "", nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	do(http.MethodGet, "/"+code, "", nil)
+	do(http.MethodGet, "/"+code, "", nil)
+	do(http.MethodHead, "/"+code, "", nil)
+	do(http.MethodGet, "/"+code+"+", "", nil)
+
+	rec = do(http.MethodGet, "/api/urls/"+code, "", owner)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get("Location"))
+	var info handlers.URLInfoResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &info))
+	assert.Equal(t, "https://example.com/a", info.OriginalURL)
+	assert.Equal(t, http.StatusMovedPermanently, info.RedirectCode)
+	assert.Equal(t, int64(2), info.Clicks)
+	assert.Equal(t, map[string]string{"team": "web"}, info.Metadata)
+	assert.NotEmpty(t, info.OwnerID)
+	assert.False(t, info.CreatedAt.IsZero())
+
+	rec = do(http.MethodGet, "/api/urls/"+code, "", nil)
+	info = handlers.URLInfoResponse{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &info))
+	assert.Empty(t, info.OwnerID)
+	assert.Equal(t, "https://example.com/a", info.OriginalURL)
+
+	rec = do(http.MethodGet, "/api/urls/"+strings.TrimPrefix(protected.Result, cfg.BaseURL+"/"), "", nil)
+	info = handlers.URLInfoResponse{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &info))
+	assert.True(t, info.PasswordProtected)
+	assert.Empty(t, info.OriginalURL)
+
+	rec = do(http.MethodGet, "/api/urls/bm90Zm91bmQ=", "", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestExpandBatch(t *testing.T) {
+	st, err := memory.NewMemoryStorage()
+	require.NoError(t, err)
+	defer st.Close()
+	require.NoError(t, st.BatchAppend(context.Background(), []types.URLEntry{
+		{UUID: "1", ShortURL: "a", OriginalURL: "https://example.com/a"},
+		{UUID: "2", ShortURL: "b", OriginalURL: "https://example.com/b", Disabled: true},
+		{UUID: "3", ShortURL: "c", OriginalURL: "https://example.com/c", PasswordHash: "x"},
+		{UUID: "4", ShortURL: "d", OriginalURL: "https://example.com/d", FallbackURL: "https://example.com/e", FailedOver: true},
+	}))
+	r := initRouter(cfg, st)
+
+	expand := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/expand/batch", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := expand(`["a","` + cfg.BaseURL + `/b","c","d","aHR0cHM6Ly9nb29nbGUuY29t","nope"]`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `[
+		{"short_url":"a","original_url":"https://example.com/a","status":"ok"},
+		{"short_url":"`+cfg.BaseURL+`/b","status":"deleted"},
+		{"short_url":"c","status":"ok","password_protected":true},
+		{"short_url":"d","original_url":"https://example.com/e","status":"ok"},
+		{"short_url":"aHR0cHM6Ly9nb29nbGUuY29t","status":"not_found"},
+		{"short_url":"nope","status":"not_found"}
+	]`, rec.Body.String())
+
+	assert.Equal(t, http.StatusBadRequest, expand(`[]`).Code)
+	assert.Equal(t, http.StatusBadRequest, expand(`{"a":1}`).Code)
+}
+
+func TestQRCode(t *testing.T) {
+	st, err := memory.NewMemoryStorage()
+	require.NoError(t, err)
+	defer st.Close()
+	require.NoError(t, st.BatchAppend(context.Background(), []types.URLEntry{
+		{UUID: "1", ShortURL: "a", OriginalURL: "https://example.com/a"},
+		{UUID: "2", ShortURL: "b", OriginalURL: "https://example.com/b", Disabled: true},
+	}))
+	r := initRouter(cfg, st)
+
+	get := func(target string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/a/qr?size=128")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "image/png", rec.Header().Get("Content-Type"))
+	img, err := png.Decode(rec.Body)
+	require.NoError(t, err)
+	assert.Equal(t, 128, img.Bounds().Dx())
+
+	etag := rec.Header().Get("ETag")
+	require.NotEmpty(t, etag)
+	assert.Equal(t, http.StatusNotModified, get("/a/qr?size=128", "If-None-Match", etag).Code)
+	// other options are another image
+	assert.NotEqual(t, etag, get("/a/qr?size=129").Header().Get("ETag"))
+
+	rec = get("/a/qr?format=svg&level=h&margin=0&fg=%23336699&bg=ffffff00")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "image/svg+xml", rec.Header().Get("Content-Type"))
+	assert.True(t, strings.HasPrefix(rec.Body.String(), "<svg"))
+	assert.Contains(t, rec.Body.String(), `fill="#336699"`)
+
+	for _, query := range []string{"format=gif", "size=10", "size=x", "level=Z", "margin=-1", "fg=red"} {
+		assert.Equal(t, http.StatusBadRequest, get("/a/qr?"+query).Code, query)
+	}
+	assert.Equal(t, http.StatusUnavailableForLegalReasons, get("/b/qr").Code)
+	assert.Equal(t, http.StatusNotFound, get("/!!/qr").Code)
+
+	// the QR code URL is returned on request
+	req := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{"url":"https://example.com/qr","qr":true}`))
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	var resp handlers.ShortenResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, resp.Result+"/qr", resp.QR)
+}
+
+func TestMetrics(t *testing.T) {
+	mem, err := memory.NewMemoryStorage()
+	require.NoError(t, err)
+	st := instrumented.NewInstrumented(mem, backendName(mem))
+	defer st.Close()
+	r := initRouter(cfg, st)
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+	require.Equal(t, http.StatusCreated, do(http.MethodPost, "/api/shorten/batch",
+		`[{"correlation_id":"1","original_url":"https://example.com/1"},{"correlation_id":"2","original_url":"https://example.com/2"}]`).Code)
+	rec := do(http.MethodPost, "/", "https://example.com/metrics")
+	require.Equal(t, http.StatusCreated, rec.Code)
+	code := strings.TrimPrefix(rec.Body.String(), cfg.BaseURL+"/")
+	require.Equal(t, http.StatusTemporaryRedirect, do(http.MethodGet, "/"+code, "").Code)
+	require.Equal(t, http.StatusOK, do(http.MethodGet, "/"+code+"/qr", "").Code)
+	do(http.MethodDelete, "/", "")
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	rec = httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	body := rec.Body.String()
+	for _, series := range []string{
+		`shortener_http_request_duration_seconds_count{method="GET",route="/{id}",status="307"}`,
+		`shortener_http_request_duration_seconds_count{method="POST",route="/api/shorten/batch",status="201"}`,
+		`shortener_http_request_duration_seconds_count{method="DELETE",route="unmatched",status="405"}`,
+		`shortener_storage_operation_duration_seconds_count{backend="memory",operation="get"}`,
+		`shortener_storage_batch_size_sum{backend="memory",operation="batch_append"}`,
+		`shortener_cache_requests_total{cache="qr",result="miss"}`,
+		`go_goroutines`,
+	} {
+		assert.Contains(t, body, series)
+	}
+}
+
+// spanRecorder installs a global tracer provider recording every span. It
+// is only set once, tracers created before keep using the first provider.
+var spanRecorder = sync.OnceValue(func() *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	return recorder
+})
+
+func TestTracing(t *testing.T) {
+	_, err := tracing.Init(tracing.Options{})
+	require.NoError(t, err)
+	recorder := spanRecorder()
+
+	mem, err := memory.NewMemoryStorage()
+	require.NoError(t, err)
+	st := instrumented.NewInstrumented(mem, backendName(mem))
+	defer st.Close()
+	require.NoError(t, st.Append(context.Background(), types.URLEntry{UUID: "1", ShortURL: "a", OriginalURL: "https://example.com/a"}))
+	r := initRouter(cfg, st)
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodGet, "/a", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusTemporaryRedirect, rec.Code)
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	// the request continues the caller's trace, storage calls are part of it
+	for _, name := range []string{"/{id}", "gzip", "storage.get", "storage.add_click"} {
+		require.Contains(t, spans, name)
+		assert.Equal(t, traceID, spans[name].SpanContext().TraceID().String(), name)
+	}
+	assert.Equal(t, "00f067aa0ba902b7", spans["/{id}"].Parent().SpanID().String())
+	assert.Equal(t, spans["/{id}"].SpanContext().SpanID(), spans["gzip"].Parent().SpanID())
+	assert.Equal(t, spans["gzip"].SpanContext().SpanID(), spans["storage.get"].Parent().SpanID())
+	assert.Contains(t, spans["/{id}"].Attributes(), attribute.Int("http.response.status_code", http.StatusTemporaryRedirect))
+
+	// missing links are not storage errors
+	_, err = st.Get(context.Background(), "missing")
+	require.ErrorIs(t, err, types.ErrNotFound)
+	ended := recorder.Ended()
+	last := ended[len(ended)-1]
+	assert.Equal(t, "storage.get", last.Name())
+	assert.False(t, last.Parent().IsValid())
+	assert.Equal(t, codes.Unset, last.Status().Code)
+}
+
+func TestRequestID(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	prev := logger.Log
+	logger.Log = zap.New(core)
+	defer func() { logger.Log = prev }()
+
+	st, err := memory.NewMemoryStorage()
+	require.NoError(t, err)
+	defer st.Close()
+	r := initRouter(cfg, st)
+
+	do := func(id, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(body))
+		if id != "" {
+			req.Header.Set("X-Request-ID", id)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do("abc-123", `{"url":"https://example.com/id"}`)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, "abc-123", rec.Header().Get("X-Request-ID"))
+	// request and response log lines can be correlated
+	for _, msg := range []string{"incoming HTTP request", "outgoing HTTP response"} {
+		entries := logs.FilterMessage(msg).AllUntimed()
+		require.Len(t, entries, 1, msg)
+		assert.Equal(t, "abc-123", entries[0].ContextMap()["request_id"], msg)
+	}
+
+	// IDs that are unsafe to log are replaced
+	for _, id := range []string{"", "a b", strings.Repeat("x", 129)} {
+		rec = do(id, `{"url":"https://example.com/id"}`)
+		got := rec.Header().Get("X-Request-ID")
+		assert.NotEqual(t, id, got)
+		_, err := uuid.Parse(got)
+		assert.NoError(t, err)
+	}
+
+	// the ID is quoted in error bodies
+	rec = do("err-1", `{`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, "Invalid JSON\nRequest ID: err-1\n", rec.Body.String())
+}
@@ -0,0 +1,188 @@
+package blocklist
+
+import (
+	"crypto/sha256"
+	"github.com/repriest/url-shortener/internal/logger"
+	"github.com/repriest/url-shortener/internal/urlservice"
+	"go.uber.org/zap"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons returned by Check.
+const (
+	ReasonDomain  = "domain"
+	ReasonURLHash = "url_hash"
+)
+
+type Options struct {
+	// DomainsPath lists one blocked domain per line, subdomains are blocked too
+	DomainsPath string
+	// HashPrefixesPath lists hex SHA-256 prefixes of URL expressions, see expressions
+	HashPrefixesPath string
+	Reload           time.Duration
+}
+
+// Blocklist matches URLs against local lists of malicious domains and URL
+// hash prefixes. Files are re-read when they change, at most every
+// Options.Reload, by whichever request notices first.
+type Blocklist struct {
+	opts  Options
+	lists atomic.Pointer[lists]
+
+	mu          sync.Mutex
+	checked     time.Time
+	domainsMod  time.Time
+	prefixesMod time.Time
+}
+
+type lists struct {
+	domains map[string]bool
+	// prefixes are grouped by length in bytes
+	prefixes map[int]map[string]bool
+}
+
+func New(opts Options) *Blocklist {
+	b := &Blocklist{opts: opts}
+	b.lists.Store(&lists{})
+	b.mu.Lock()
+	b.reload()
+	b.mu.Unlock()
+	return b
+}
+
+// Validate reports whether the configured files can be loaded.
+func Validate(domainsPath, hashPrefixesPath string) error {
+	if domainsPath != "" {
+		if _, _, err := readDomains(domainsPath); err != nil {
+			return err
+		}
+	}
+	if hashPrefixesPath != "" {
+		if _, _, err := readHashPrefixes(hashPrefixesPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check returns why rawURL is blocked, or "" if it is not.
+func (b *Blocklist) Check(rawURL string) string {
+	if b.opts.DomainsPath == "" && b.opts.HashPrefixesPath == "" {
+		return ""
+	}
+	// requests arriving during a reload use the current lists
+	if b.mu.TryLock() {
+		if time.Since(b.checked) >= b.opts.Reload {
+			b.reload()
+		}
+		b.mu.Unlock()
+	}
+	l := b.lists.Load()
+
+	canonical, err := urlservice.Canonicalize(rawURL, urlservice.CanonicalOptions{})
+	if err != nil {
+		return ""
+	}
+	u, err := url.Parse(canonical)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+
+	for host := u.Hostname(); ; {
+		if l.domains[host] {
+			return ReasonDomain
+		}
+		_, parent, ok := strings.Cut(host, ".")
+		if !ok {
+			break
+		}
+		host = parent
+	}
+
+	if len(l.prefixes) > 0 {
+		for _, expr := range expressions(u) {
+			sum := sha256.Sum256([]byte(expr))
+			for n, set := range l.prefixes {
+				if set[string(sum[:n])] {
+					return ReasonURLHash
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// reload re-reads files whose modification time changed. Callers hold b.mu.
+// A file that cannot be read keeps its previous entries.
+func (b *Blocklist) reload() {
+	b.checked = time.Now()
+	current := b.lists.Load()
+	next := *current
+
+	if b.opts.DomainsPath != "" {
+		if domains, mod, err := readDomainsIfChanged(b.opts.DomainsPath, b.domainsMod); err != nil {
+			logger.Log.Error("could not load blocked domains", zap.String("path", b.opts.DomainsPath), zap.Error(err))
+		} else if domains != nil {
+			next.domains, b.domainsMod = domains, mod
+			logger.Log.Info("blocked domains loaded", zap.Int("count", len(domains)))
+		}
+	}
+	if b.opts.HashPrefixesPath != "" {
+		if prefixes, mod, err := readHashPrefixesIfChanged(b.opts.HashPrefixesPath, b.prefixesMod); err != nil {
+			logger.Log.Error("could not load blocked hash prefixes", zap.String("path", b.opts.HashPrefixesPath), zap.Error(err))
+		} else if prefixes != nil {
+			next.prefixes, b.prefixesMod = prefixes, mod
+			logger.Log.Info("blocked hash prefixes loaded", zap.Int("lengths", len(prefixes)))
+		}
+	}
+	b.lists.Store(&next)
+}
+
+// expressions returns the host suffix and path prefix combinations a URL is
+// looked up by, in the style of Safe Browsing: the exact host and up to four
+// parent domains, each with the full path and query, the path, and up to four
+// leading path prefixes.
+func expressions(u *url.URL) []string {
+	var hosts []string
+	host := u.Hostname()
+	hosts = append(hosts, host)
+	if _, err := netip.ParseAddr(host); err != nil {
+		parts := strings.Split(host, ".")
+		// the last five components at most, never the bare TLD
+		start := max(1, len(parts)-5)
+		for i := start; i < len(parts)-1; i++ {
+			hosts = append(hosts, strings.Join(parts[i:], "."))
+		}
+	}
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	var paths []string
+	if u.RawQuery != "" {
+		paths = append(paths, path+"?"+u.RawQuery)
+	}
+	paths = append(paths, path)
+	prefix := "/"
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i := 0; i < len(segments) && len(paths) < 6; i++ {
+		if prefix != path {
+			paths = append(paths, prefix)
+		}
+		prefix += segments[i] + "/"
+	}
+
+	exprs := make([]string, 0, len(hosts)*len(paths))
+	for _, h := range hosts {
+		for _, p := range paths {
+			exprs = append(exprs, h+p)
+		}
+	}
+	return exprs
+}
@@ -0,0 +1,61 @@
+package blocklist
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExpressions(t *testing.T) {
+	u, err := url.Parse("http://a.b.c/1/2.html?param=1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"a.b.c/1/2.html?param=1", "a.b.c/1/2.html", "a.b.c/", "a.b.c/1/",
+		"b.c/1/2.html?param=1", "b.c/1/2.html", "b.c/", "b.c/1/",
+	}, expressions(u))
+
+	u, err = url.Parse("http://1.2.3.4")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.2.3.4/"}, expressions(u))
+}
+
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+	domains := filepath.Join(dir, "domains.txt")
+	prefixes := filepath.Join(dir, "prefixes.txt")
+	sum := sha256.Sum256([]byte("evil.example/phish/"))
+	require.NoError(t, os.WriteFile(domains, []byte("# malware\nmalware.example\n"), 0o644))
+	require.NoError(t, os.WriteFile(prefixes, []byte(hex.EncodeToString(sum[:4])+"\n"), 0o644))
+	require.NoError(t, Validate(domains, prefixes))
+
+	b := New(Options{DomainsPath: domains, HashPrefixesPath: prefixes})
+	tt := []struct {
+		url  string
+		want string
+	}{
+		{"https://malware.example", ReasonDomain},
+		{"https://cdn.MALWARE.example/x", ReasonDomain},
+		{"https://notmalware.example", ""},
+		{"https://evil.example/phish/login?x=1", ReasonURLHash},
+		{"https://www.evil.example/phish/", ReasonURLHash},
+		{"https://evil.example/other", ""},
+	}
+	for _, tc := range tt {
+		assert.Equal(t, tc.want, b.Check(tc.url), tc.url)
+	}
+
+	// changed files are picked up on the next check
+	require.NoError(t, os.WriteFile(domains, []byte("evil.example\n"), 0o644))
+	require.NoError(t, os.Chtimes(domains, time.Now(), time.Now().Add(time.Minute)))
+	assert.Equal(t, "", b.Check("https://malware.example"))
+	assert.Equal(t, ReasonDomain, b.Check("https://evil.example/other"))
+
+	require.NoError(t, os.WriteFile(prefixes, []byte("xyz\n"), 0o644))
+	assert.Error(t, Validate("", prefixes))
+}
@@ -0,0 +1,103 @@
+package blocklist
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	minPrefixLen = 4
+	maxPrefixLen = 32
+)
+
+// readDomainsIfChanged returns nil domains if the file was not modified since mod.
+func readDomainsIfChanged(path string, mod time.Time) (map[string]bool, time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, mod, fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	if info.ModTime().Equal(mod) {
+		return nil, mod, nil
+	}
+	return readDomains(path)
+}
+
+func readHashPrefixesIfChanged(path string, mod time.Time) (map[int]map[string]bool, time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, mod, fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	if info.ModTime().Equal(mod) {
+		return nil, mod, nil
+	}
+	return readHashPrefixes(path)
+}
+
+func readDomains(path string) (map[string]bool, time.Time, error) {
+	domains := make(map[string]bool)
+	mod, err := readLines(path, func(line string) error {
+		domains[strings.ToLower(strings.Trim(line, "."))] = true
+		return nil
+	})
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return domains, mod, nil
+}
+
+func readHashPrefixes(path string) (map[int]map[string]bool, time.Time, error) {
+	prefixes := make(map[int]map[string]bool)
+	mod, err := readLines(path, func(line string) error {
+		prefix, err := hex.DecodeString(line)
+		if err != nil {
+			return fmt.Errorf("invalid hash prefix %q: %w", line, err)
+		}
+		if len(prefix) < minPrefixLen || len(prefix) > maxPrefixLen {
+			return fmt.Errorf("hash prefix %q must be %d to %d bytes", line, minPrefixLen, maxPrefixLen)
+		}
+		if prefixes[len(prefix)] == nil {
+			prefixes[len(prefix)] = make(map[string]bool)
+		}
+		prefixes[len(prefix)][string(prefix)] = true
+		return nil
+	})
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return prefixes, mod, nil
+}
+
+// readLines calls fn for every non-empty line without "#" comments and
+// returns the file's modification time.
+func readLines(path string, fn func(line string) error) (time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return time.Time{}, fmt.Errorf("%s line %d: %w", path, n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return time.Time{}, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return info.ModTime(), nil
+}
@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/repriest/url-shortener/internal/logger"
+	"github.com/repriest/url-shortener/internal/storage/encrypted"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+)
+
+// AdminOnly lets through requests carrying the configured admin bearer token.
+// The admin API is disabled when no token is configured.
+func (h *Handler) AdminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.cfg.AdminToken == "" {
+			http.Error(w, "Admin API is disabled", http.StatusForbidden)
+			return
+		}
+		if !h.isAdmin(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isAdmin reports whether r carries the admin bearer token.
+func (h *Handler) isAdmin(r *http.Request) bool {
+	if h.cfg.AdminToken == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(h.cfg.AdminToken)) == 1
+}
+
+// RotateKeysHandler re-encrypts stored URLs with the active keyring key.
+func (h *Handler) RotateKeysHandler(w http.ResponseWriter, r *http.Request) {
+	es, ok := storageAs[*encrypted.EncryptedStorage](h.st)
+	if !ok {
+		http.Error(w, "Encryption is not enabled", http.StatusConflict)
+		return
+	}
+
+	rotated, err := es.Rotate(r.Context())
+	if err != nil {
+		logger.FromContext(r.Context()).Error("key rotation failed", zap.Int("rotated", rotated), zap.Error(err))
+		h.writeStorageError(w, err, "Key rotation failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	respJSON, err := json.Marshal(RotateKeysResponse{Rotated: rotated})
+	if err != nil {
+		http.Error(w, "Could not encode response", http.StatusInternalServerError)
+		return
+	}
+	writeResponse(w, respJSON)
+}
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"fmt"
+	t "github.com/repriest/url-shortener/internal/storage/types"
+	"github.com/repriest/url-shortener/internal/useragent"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// associationPaths are the paths apps may open, the API stays in the browser.
+var associationPaths = []string{"NOT /api/*", "NOT /ping", "*"}
+
+// openApp sends mobile visitors to the link's app: web app links and store
+// URLs are redirected to, custom schemes get a page that tries the app and
+// falls back to the store or webURL. It reports false when the request
+// should get the web redirect.
+func openApp(w http.ResponseWriter, r *http.Request, link *t.AppLink, webURL string, code int) bool {
+	appURL, storeURL := appTarget(r.UserAgent(), link)
+	switch {
+	case appURL == "" && storeURL == "":
+		return false
+	case appURL == "":
+		http.Redirect(w, r, storeURL, code)
+	case isWebURL(appURL):
+		http.Redirect(w, r, appURL, code)
+	default:
+		fallback := storeURL
+		if fallback == "" {
+			fallback = webURL
+		}
+		renderPage(w, r, http.StatusOK, "applink.html", struct {
+			// validated custom schemes would be filtered out as plain strings
+			AppURL      template.URL
+			FallbackURL string
+		}{template.URL(appURL), fallback})
+	}
+	return true
+}
+
+// appTarget returns the app URI and store URL for the request's platform.
+func appTarget(userAgent string, link *t.AppLink) (string, string) {
+	if link == nil {
+		return "", ""
+	}
+	switch useragent.Platform(userAgent) {
+	case useragent.PlatformIOS:
+		return link.IOSURL, link.IOSStoreURL
+	case useragent.PlatformAndroid:
+		return link.AndroidURL, link.AndroidStoreURL
+	}
+	return "", ""
+}
+
+func validateAppLink(link t.AppLink) error {
+	for _, u := range []string{link.IOSURL, link.AndroidURL} {
+		if u == "" {
+			continue
+		}
+		parsed, err := url.Parse(u)
+		if err != nil || parsed.Scheme == "" {
+			return fmt.Errorf("invalid app URL %q", u)
+		}
+		switch strings.ToLower(parsed.Scheme) {
+		case "javascript", "data", "vbscript", "file":
+			return fmt.Errorf("app URL scheme %q is not allowed", parsed.Scheme)
+		}
+	}
+	for _, u := range []string{link.IOSStoreURL, link.AndroidStoreURL} {
+		if u != "" && !isWebURL(u) {
+			return fmt.Errorf("invalid store URL %q", u)
+		}
+	}
+	return nil
+}
+
+func isWebURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// AppleAppSiteAssociationHandler lets the configured iOS apps open short links.
+func (h *Handler) AppleAppSiteAssociationHandler(w http.ResponseWriter, r *http.Request) {
+	if len(h.cfg.AppleAppIDs) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	aasa := AppleAppSiteAssociation{AppLinks: AppleAppLinks{Apps: []string{}}}
+	for _, id := range h.cfg.AppleAppIDs {
+		aasa.AppLinks.Details = append(aasa.AppLinks.Details, AppleAppDetails{AppID: id, Paths: associationPaths})
+	}
+	writeJSON(w, aasa)
+}
+
+// AssetLinksHandler lets the configured Android app open short links.
+func (h *Handler) AssetLinksHandler(w http.ResponseWriter, r *http.Request) {
+	if h.cfg.AndroidPackage == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	writeJSON(w, []AssetLink{{
+		Relation: []string{"delegate_permission/common.handle_all_urls"},
+		Target: AssetLinkTarget{
+			Namespace:              "android_app",
+			PackageName:            h.cfg.AndroidPackage,
+			SHA256CertFingerprints: h.cfg.AndroidCertFingerprints,
+		},
+	}})
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const maxExpandBatch = 10000
+
+// Expand statuses. Taken down links are reported as deleted, links whose
+// destination is on the blocklist as blocked.
+const (
+	expandOK       = "ok"
+	expandNotFound = "not_found"
+	expandDeleted  = "deleted"
+	expandBlocked  = "blocked"
+)
+
+// ExpandBatchHandler resolves short codes or full short URLs to their
+// destinations with a single storage lookup. Results are in request order.
+// Only stored links are resolved, codes are not decoded.
+func (h *Handler) ExpandBatchHandler(w http.ResponseWriter, r *http.Request) {
+	var req []string
+	body, err := readRequestBody(r)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if len(req) == 0 {
+		http.Error(w, "Empty batch", http.StatusBadRequest)
+		return
+	}
+	if len(req) > maxExpandBatch {
+		http.Error(w, fmt.Sprintf("At most %d URLs are allowed", maxExpandBatch), http.StatusBadRequest)
+		return
+	}
+
+	codes := make([]string, len(req))
+	for i, s := range req {
+		codes[i] = strings.TrimPrefix(s, h.cfg.BaseURL+"/")
+	}
+	entries, err := h.st.GetMany(r.Context(), codes)
+	if err != nil {
+		h.writeStorageError(w, err, "Could not read URLs from storage")
+		return
+	}
+
+	resp := make([]ExpandBatchResponse, len(req))
+	for i, code := range codes {
+		resp[i] = ExpandBatchResponse{ShortURL: req[i], Status: expandOK}
+		entry, ok := entries[code]
+		switch {
+		case !ok:
+			resp[i].Status = expandNotFound
+		case entry.Disabled:
+			resp[i].Status = expandDeleted
+		case entry.PasswordHash != "":
+			resp[i].PasswordProtected = true
+		default:
+			longURL := entry.OriginalURL
+			if entry.FailedOver && entry.FallbackURL != "" {
+				longURL = entry.FallbackURL
+			}
+			// links are checked on every visit, see ExpandHandler
+			if h.blocklist.Check(longURL) != "" {
+				resp[i].Status = expandBlocked
+				continue
+			}
+			resp[i].OriginalURL = longURL
+		}
+	}
+	writeJSON(w, resp)
+}
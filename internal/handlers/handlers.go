@@ -7,8 +7,10 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/repriest/url-shortener/internal/logger"
+	"github.com/repriest/url-shortener/internal/storage/breaker"
 	t "github.com/repriest/url-shortener/internal/storage/types"
-	"github.com/repriest/url-shortener/internal/urlservice"
+	"go.uber.org/zap"
 	"net/http"
 	"time"
 )
@@ -25,21 +27,31 @@ func (h *Handler) ShortenHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// shorten URL
-	shortURL, err := urlservice.ShortenURL(longURL)
+	longURL, err = h.canonicalize(longURL)
 	if err != nil {
 		http.Error(w, "Could not shorten URL", http.StatusBadRequest)
 		return
 	}
-	responseURL := h.cfg.BaseURL + "/" + shortURL
-
+	shortURL, err := h.shortCode(longURL, LinkOptions{})
+	if err != nil {
+		http.Error(w, "Could not shorten URL", http.StatusBadRequest)
+		return
+	}
+	if urlErr := h.checkURL(longURL); urlErr != nil {
+		writeURLErrors(w, r, *urlErr)
+		return
+	}
 	entry := t.URLEntry{
 		UUID:        uuid.New().String(),
 		ShortURL:    shortURL,
 		OriginalURL: longURL,
+		CreatedAt:   time.Now().UTC(),
+		OwnerID:     userID(r),
 	}
 
 	// check existing shortURL
-	err = h.st.Append(entry)
+	err = h.appendEntry(r.Context(), &entry)
+	responseURL := h.cfg.BaseURL + "/" + entry.ShortURL
 	if err != nil {
 		var urlConflictError *t.URLConflictError
 		if errors.As(err, &urlConflictError) { // get instance of URLConflictError if err matches
@@ -54,7 +66,7 @@ func (h *Handler) ShortenHandler(w http.ResponseWriter, r *http.Request) {
 			}
 			return
 		}
-		http.Error(w, "Could not write URL to storage", http.StatusInternalServerError)
+		h.writeStorageError(w, err, "Could not write URL to storage")
 		return
 	}
 
@@ -67,13 +79,60 @@ func (h *Handler) ShortenHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) ExpandHandler(w http.ResponseWriter, r *http.Request) {
-	shortURL := chi.URLParam(r, "id")
-	longURL, err := urlservice.ExpandURL(shortURL)
+	entry, preview, err := h.lookupPreview(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		writeLookupError(w, r, err)
+		return
+	}
+	if entry.Disabled {
+		writeDisabled(w, r, entry.ShortURL)
+		return
+	}
+	if entry.PasswordHash != "" && !h.unlocked(r, entry) {
+		renderPasswordForm(w, r, http.StatusOK, "")
+		return
+	}
+
+	rule, variant := h.pickTarget(w, r, &entry)
+
+	longURL, err := destination(r, entry)
+	if errors.Is(err, errSuffixNotAllowed) {
+		http.NotFound(w, r)
+		return
+	}
 	if err != nil {
-		http.Error(w, "Could not decode URL", http.StatusBadRequest)
+		http.Error(w, "Could not forward request", http.StatusBadRequest)
+		return
+	}
+
+	// links are checked on every visit, so they stop working once blocked
+	if reason := h.blocklist.Check(longURL); reason != "" {
+		logger.FromContext(r.Context()).Warn("blocked link visited", zap.String("short_url", entry.ShortURL), zap.String("reason", reason))
+		renderPage(w, r, http.StatusForbidden, "blocked.html", nil)
+		return
+	}
+
+	if preview || entry.Interstitial {
+		logClick(r.Context(), entry, rule, variant)
+		// asking for a preview is not a visit, an interstitial page is
+		if !preview {
+			h.countClick(r, entry, variant)
+		}
+		h.renderPreview(w, r, entry, longURL)
+		return
+	}
+
+	code := entry.RedirectCode
+	if code == 0 {
+		code = h.cfg.RedirectCode
+	}
+	h.setCacheHeaders(w, entry, code)
+	logClick(r.Context(), entry, rule, variant)
+	h.countClick(r, entry, variant)
+	if openApp(w, r, entry.AppLink, longURL, code) {
 		return
 	}
-	http.Redirect(w, r, longURL, http.StatusTemporaryRedirect)
+	http.Redirect(w, r, longURL, code)
 }
 
 func (h *Handler) ShortenJSONHandler(w http.ResponseWriter, r *http.Request) {
@@ -95,28 +154,46 @@ func (h *Handler) ShortenJSONHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "URL is required", http.StatusBadRequest)
 		return
 	}
+	if err := req.LinkOptions.validate(); err != nil {
+		http.Error(w, "Invalid link options: "+err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	// shorten URL
-	shortURL, err := urlservice.ShortenURL(req.URL)
+	req.URL, err = h.canonicalize(req.URL)
 	if err != nil {
 		http.Error(w, "Could not shorten URL", http.StatusBadRequest)
 		return
 	}
-	responseURL := ShortenResponse{h.cfg.BaseURL + "/" + shortURL}
-
+	shortURL, err := h.shortCode(req.URL, req.LinkOptions)
+	if err != nil {
+		http.Error(w, "Could not shorten URL", http.StatusBadRequest)
+		return
+	}
+	if urlErr := h.checkLink(req.URL, req.LinkOptions); urlErr != nil {
+		writeURLErrors(w, r, *urlErr)
+		return
+	}
 	entry := t.URLEntry{
 		UUID:        uuid.New().String(),
 		ShortURL:    shortURL,
 		OriginalURL: req.URL,
+		CreatedAt:   time.Now().UTC(),
+		OwnerID:     userID(r),
+	}
+	if err := req.LinkOptions.apply(&entry); err != nil {
+		http.Error(w, "Could not apply link options", http.StatusInternalServerError)
+		return
 	}
 
 	// check existing shortURL
-	err = h.st.Append(entry)
+	err = h.appendEntry(r.Context(), &entry)
+	responseURL := h.shortenResponse(entry.ShortURL, req.QR)
 	if err != nil {
 		var urlConflictError *t.URLConflictError
 		if errors.As(err, &urlConflictError) { // get instance of URLConflictError if err matches
 			if urlConflictError.ShortURL != "" {
-				responseURL = ShortenResponse{h.cfg.BaseURL + "/" + urlConflictError.ShortURL}
+				responseURL = h.shortenResponse(urlConflictError.ShortURL, req.QR)
 			}
 			// write existing shortened URL
 			w.Header().Set("Content-Type", "application/json")
@@ -129,7 +206,7 @@ func (h *Handler) ShortenJSONHandler(w http.ResponseWriter, r *http.Request) {
 			writeResponse(w, respJSON)
 			return
 		}
-		http.Error(w, "Could not write URL to storage", http.StatusInternalServerError)
+		h.writeStorageError(w, err, "Could not write URL to storage")
 		return
 	}
 
@@ -145,6 +222,20 @@ func (h *Handler) ShortenJSONHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) PingHandler(w http.ResponseWriter, r *http.Request) {
+	// report circuit breaker state if storage is wrapped in one
+	if b, ok := storageAs[*breaker.Breaker](h.st); ok {
+		state := b.State()
+		w.Header().Set("X-Circuit-Breaker", state.String())
+		if state == breaker.StateOpen {
+			http.Error(w, "Storage circuit breaker is open", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	if active, _, _ := h.ro.Active(); active {
+		w.Header().Set("X-Read-Only", "true")
+	}
+
 	if h.cfg.DatabaseDSN == "" {
 		w.WriteHeader(http.StatusOK)
 		return
@@ -182,6 +273,7 @@ func (h *Handler) ShortenBatchHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var entries []t.URLEntry
+	var urlErrs []URLError
 
 	// parese entries
 	for _, reqEntry := range req {
@@ -189,15 +281,35 @@ func (h *Handler) ShortenBatchHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Empty URL", http.StatusBadRequest)
 			return
 		}
-		shortURL, err := urlservice.ShortenURL(reqEntry.OriginalURL)
+		if err := reqEntry.LinkOptions.validate(); err != nil {
+			http.Error(w, "Invalid link options: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		reqEntry.OriginalURL, err = h.canonicalize(reqEntry.OriginalURL)
 		if err != nil {
 			http.Error(w, "Could not shorten URL", http.StatusBadRequest)
 			return
 		}
+		shortURL, err := h.shortCode(reqEntry.OriginalURL, reqEntry.LinkOptions)
+		if err != nil {
+			http.Error(w, "Could not shorten URL", http.StatusBadRequest)
+			return
+		}
+		if urlErr := h.checkLink(reqEntry.OriginalURL, reqEntry.LinkOptions); urlErr != nil {
+			urlErr.CorrelationID = reqEntry.CorrelationID
+			urlErrs = append(urlErrs, *urlErr)
+			continue
+		}
 		entry := t.URLEntry{
 			UUID:        reqEntry.CorrelationID,
 			ShortURL:    shortURL,
 			OriginalURL: reqEntry.OriginalURL,
+			CreatedAt:   time.Now().UTC(),
+			OwnerID:     userID(r),
+		}
+		if err := reqEntry.LinkOptions.apply(&entry); err != nil {
+			http.Error(w, "Could not apply link options", http.StatusInternalServerError)
+			return
 		}
 		entries = append(entries, entry)
 		resp = append(resp, ShortenBatchResponse{
@@ -206,9 +318,24 @@ func (h *Handler) ShortenBatchHandler(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
-	err = h.st.BatchAppend(entries)
+	// every rejected URL is reported at once
+	if len(urlErrs) > 0 {
+		writeURLErrors(w, r, urlErrs...)
+		return
+	}
+
+	changed, err := h.freeCodes(r.Context(), entries)
+	if err != nil {
+		h.writeStorageError(w, err, "Failed to batch append")
+		return
+	}
+	for _, i := range changed {
+		resp[i].ShortURL = h.cfg.BaseURL + "/" + entries[i].ShortURL
+	}
+
+	err = h.st.BatchAppend(r.Context(), entries)
 	if err != nil {
-		http.Error(w, "Failed to batch append", http.StatusInternalServerError)
+		h.writeStorageError(w, err, "Failed to batch append")
 		return
 	}
 
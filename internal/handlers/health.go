@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"github.com/repriest/url-shortener/internal/healthcheck"
+	"net/http"
+)
+
+// LinkHealthHandler returns the destination check history of a link.
+func (h *Handler) LinkHealthHandler(w http.ResponseWriter, r *http.Request) {
+	c, ok := storageAs[*healthcheck.Checker](h.st)
+	if !ok {
+		http.Error(w, "Health checks are disabled", http.StatusConflict)
+		return
+	}
+	entry, ok := h.getEntry(w, r)
+	if !ok {
+		return
+	}
+
+	health, _ := c.Health(entry.ShortURL)
+	if health.Results == nil {
+		health.Results = []healthcheck.Result{}
+	}
+	writeJSON(w, LinkHealthResponse{
+		ShortURL:    entry.ShortURL,
+		FallbackURL: entry.FallbackURL,
+		FailedOver:  entry.FailedOver,
+		Health:      health,
+	})
+}
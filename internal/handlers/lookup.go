@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	t "github.com/repriest/url-shortener/internal/storage/types"
+	"net/http"
+)
+
+// LookupHandler finds the short links of a destination. The URL is
+// canonicalized first, as it is when shortening.
+func (h *Handler) LookupHandler(w http.ResponseWriter, r *http.Request) {
+	rawURL := r.URL.Query().Get("url")
+	if rawURL == "" {
+		http.Error(w, "URL is required", http.StatusBadRequest)
+		return
+	}
+	longURL, err := h.canonicalize(rawURL)
+	if err != nil {
+		http.Error(w, "Invalid URL", http.StatusBadRequest)
+		return
+	}
+
+	hash := t.HashURL(longURL)
+	if hasher, ok := storageAs[t.URLHasher](h.st); ok {
+		hash = hasher.HashURL(longURL)
+	}
+	entries, err := h.st.FindByURLHash(r.Context(), hash)
+	if err != nil {
+		h.writeStorageError(w, err, "Could not read URL from storage")
+		return
+	}
+
+	resp := LookupResponse{URL: longURL, Links: []LookupLink{}}
+	for _, entry := range entries {
+		// taken down links are not handed out
+		if entry.Disabled {
+			continue
+		}
+		resp.Links = append(resp.Links, LookupLink{
+			ShortCode: entry.ShortURL,
+			ShortURL:  h.cfg.BaseURL + "/" + entry.ShortURL,
+		})
+	}
+	if len(resp.Links) == 0 {
+		http.Error(w, "URL not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, resp)
+}
+
+// URLInfoHandler describes a link without redirecting. The destination of
+// password-protected and disabled links is only shown to the owner and
+// admins, or to clients that unlocked the link.
+func (h *Handler) URLInfoHandler(w http.ResponseWriter, r *http.Request) {
+	entry, ok := h.getEntry(w, r)
+	if !ok {
+		return
+	}
+	clicks, err := h.st.Clicks(r.Context(), entry.ShortURL)
+	if err != nil {
+		h.writeStorageError(w, err, "Could not read clicks from storage")
+		return
+	}
+
+	code := entry.RedirectCode
+	if code == 0 {
+		code = h.cfg.RedirectCode
+	}
+	resp := URLInfoResponse{
+		ShortCode:         entry.ShortURL,
+		ShortURL:          h.cfg.BaseURL + "/" + entry.ShortURL,
+		OriginalURL:       entry.OriginalURL,
+		CreatedAt:         entry.CreatedAt,
+		RedirectCode:      code,
+		Clicks:            clicks[""],
+		PasswordProtected: entry.PasswordHash != "",
+		Disabled:          entry.Disabled,
+		Metadata:          entry.Metadata,
+	}
+	// clicks of variants are also reported separately
+	for variant, count := range clicks {
+		if variant == "" {
+			continue
+		}
+		resp.Clicks += count
+		if resp.VariantClicks == nil {
+			resp.VariantClicks = make(map[string]int64)
+		}
+		resp.VariantClicks[variant] = count
+	}
+	canEdit := h.canEdit(r, entry)
+	if canEdit {
+		resp.OwnerID = entry.OwnerID
+	}
+	hidden := entry.Disabled || entry.PasswordHash != "" && !h.unlocked(r, entry)
+	if hidden && !canEdit {
+		resp.OriginalURL = ""
+	}
+	writeJSON(w, resp)
+}
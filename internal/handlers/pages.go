@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"github.com/repriest/url-shortener/internal/logger"
+	"go.uber.org/zap"
+	"html/template"
+	"net/http"
+	"path/filepath"
+)
+
+//go:embed templates/*.html
+var templateFS embed.FS
+
+var pages = template.Must(template.ParseFS(templateFS, "templates/*.html"))
+
+// LoadTemplates replaces the embedded templates with the *.html files in dir
+// that have the same name. Other files are added and can be used as partials.
+// An empty dir restores the embedded templates.
+func LoadTemplates(dir string) error {
+	loaded, err := template.ParseFS(templateFS, "templates/*.html")
+	if err != nil {
+		return fmt.Errorf("failed to parse embedded templates: %w", err)
+	}
+	if dir != "" {
+		if _, err := loaded.ParseGlob(filepath.Join(dir, "*.html")); err != nil {
+			return fmt.Errorf("failed to parse templates in %s: %w", dir, err)
+		}
+	}
+	pages = loaded
+	return nil
+}
+
+// renderPage writes the named HTML template. Pages depend on the request, so
+// they are never cached.
+func renderPage(w http.ResponseWriter, r *http.Request, status int, name string, data any) {
+	var buf bytes.Buffer
+	if err := pages.ExecuteTemplate(&buf, name, data); err != nil {
+		logger.FromContext(r.Context()).Error("could not render page", zap.String("page", name), zap.Error(err))
+		http.Error(w, "Could not render page", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	writeResponse(w, buf.Bytes())
+}
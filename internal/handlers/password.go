@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/repriest/url-shortener/internal/logger"
+	t "github.com/repriest/url-shortener/internal/storage/types"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UnlockHandler checks the password of a protected link. A correct password
+// sets a signed cookie and sends the client back to the link, wrong ones are
+// counted per link and client IP.
+func (h *Handler) UnlockHandler(w http.ResponseWriter, r *http.Request) {
+	// the form is also shown on the preview URL of the link, see lookupPreview
+	id := chi.URLParam(r, "id")
+	entry, err := h.st.Get(r.Context(), id)
+	if code, ok := strings.CutSuffix(id, "+"); ok && code != "" && errors.Is(err, t.ErrNotFound) {
+		entry, err = h.st.Get(r.Context(), code)
+	}
+	if errors.Is(err, t.ErrNotFound) || (err == nil && entry.PasswordHash == "") {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		h.writeStorageError(w, err, "Could not read URL from storage")
+		return
+	}
+
+	key := entry.ShortURL + "|" + clientIP(r)
+	if ok, wait := h.attempts.Allow(key); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(wait)))
+		renderPasswordForm(w, r, http.StatusTooManyRequests, "Too many attempts, try again later.")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 4096)
+	password := r.PostFormValue("password")
+	if bcrypt.CompareHashAndPassword([]byte(entry.PasswordHash), []byte(password)) != nil {
+		h.attempts.Fail(key)
+		logger.FromContext(r.Context()).Info("wrong link password", zap.String("short_url", entry.ShortURL), zap.String("ip", clientIP(r)))
+		renderPasswordForm(w, r, http.StatusForbidden, "Wrong password.")
+		return
+	}
+	h.attempts.Reset(key)
+
+	expires := time.Now().Add(h.cfg.PasswordUnlockTTL)
+	http.SetCookie(w, &http.Cookie{
+		Name:     linkCookieName("p_", entry.ShortURL),
+		Value:    h.signUnlock(entry, expires),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || strings.HasPrefix(h.cfg.BaseURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	// the form posts to the link itself, so this keeps path suffix and query
+	http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+}
+
+// unlocked reports whether the request carries a valid unlock cookie for entry.
+func (h *Handler) unlocked(r *http.Request, entry t.URLEntry) bool {
+	c, err := r.Cookie(linkCookieName("p_", entry.ShortURL))
+	if err != nil {
+		return false
+	}
+	exp, _, ok := strings.Cut(c.Value, ".")
+	if !ok {
+		return false
+	}
+	unix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || time.Now().Unix() >= unix {
+		return false
+	}
+	return hmac.Equal([]byte(c.Value), []byte(h.signUnlock(entry, time.Unix(unix, 0))))
+}
+
+// signUnlock returns "expiry.signature". The signature covers the password
+// hash, so changing the password invalidates existing cookies.
+func (h *Handler) signUnlock(entry t.URLEntry, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	mac := hmac.New(sha256.New, h.cookieKey)
+	mac.Write([]byte(entry.ShortURL + "\x00" + entry.PasswordHash + "\x00" + exp))
+	return exp + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func renderPasswordForm(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	renderPage(w, r, status, "password.html", struct{ Error string }{msg})
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/repriest/url-shortener/internal/requestid"
+	t "github.com/repriest/url-shortener/internal/storage/types"
+	"github.com/repriest/url-shortener/internal/urlpolicy"
+	"github.com/repriest/url-shortener/internal/urlservice"
+	"net/http"
+)
+
+// canonicalize rewrites rawURL to the form that is stored and deduplicated.
+func (h *Handler) canonicalize(rawURL string) (string, error) {
+	return urlservice.Canonicalize(rawURL, urlservice.CanonicalOptions{
+		SortQuery:     h.cfg.CanonicalSortQuery,
+		StripTracking: h.cfg.CanonicalStripTracking,
+	})
+}
+
+// shortCode returns the code of a new link to longURL. Codes encode the URL
+// unless storage hides it, see t.ShortCoder. Password-protected links get
+// random codes, so their destination cannot be told from the code.
+func (h *Handler) shortCode(longURL string, o LinkOptions) (string, error) {
+	shortURL, err := urlservice.ShortenURL(longURL)
+	if err != nil {
+		return "", err
+	}
+	if o.Password != "" {
+		return urlservice.RandomCode(), nil
+	}
+	if coder, ok := storageAs[t.ShortCoder](h.st); ok {
+		return coder.ShortCode(longURL), nil
+	}
+	return shortURL, nil
+}
+
+// appendEntry stores a new link. If its code is taken by a link to another
+// URL, which happens once a link is edited, a random code is used instead.
+func (h *Handler) appendEntry(ctx context.Context, entry *t.URLEntry) error {
+	err := h.st.Append(ctx, *entry)
+	if errors.Is(err, t.ErrShortURLTaken) {
+		entry.ShortURL = urlservice.RandomCode()
+		err = h.st.Append(ctx, *entry)
+	}
+	return err
+}
+
+// freeCodes gives entries whose code is taken by a link to another URL a
+// random code, see appendEntry. It returns the entries that changed.
+func (h *Handler) freeCodes(ctx context.Context, entries []t.URLEntry) ([]int, error) {
+	codes := make([]string, len(entries))
+	for i, entry := range entries {
+		codes[i] = entry.ShortURL
+	}
+	taken, err := h.st.GetMany(ctx, codes)
+	if err != nil {
+		return nil, err
+	}
+	var changed []int
+	for i, entry := range entries {
+		existing, ok := taken[entry.ShortURL]
+		if !ok || existing.OriginalURL == entry.OriginalURL && existing.PasswordHash == "" && entry.PasswordHash == "" {
+			continue
+		}
+		entries[i].ShortURL = urlservice.RandomCode()
+		changed = append(changed, i)
+	}
+	return changed, nil
+}
+
+// checkURL returns why the URL policy or the blocklist rejects rawURL, or
+// nil if it is accepted.
+func (h *Handler) checkURL(rawURL string) *URLError {
+	err := h.policy.Check(rawURL)
+	var v *urlpolicy.Violation
+	if errors.As(err, &v) {
+		return &URLError{Code: v.Code, Message: v.Message, URL: rawURL}
+	}
+	if err != nil {
+		return &URLError{Code: "invalid_url", Message: err.Error(), URL: rawURL}
+	}
+	if reason := h.blocklist.Check(rawURL); reason != "" {
+		return &URLError{Code: "blocked", Message: "destination is blocked (" + reason + ")", URL: rawURL}
+	}
+	return nil
+}
+
+// checkURLs checks every URL like checkURL and returns all rejections.
+func (h *Handler) checkURLs(rawURLs ...string) []URLError {
+	var errs []URLError
+	for _, rawURL := range rawURLs {
+		if urlErr := h.checkURL(rawURL); urlErr != nil {
+			errs = append(errs, *urlErr)
+		}
+	}
+	return errs
+}
+
+// checkLink checks rawURL and the fallback URL of the link options.
+func (h *Handler) checkLink(rawURL string, o LinkOptions) *URLError {
+	if urlErr := h.checkURL(rawURL); urlErr != nil {
+		return urlErr
+	}
+	if o.FallbackURL != "" {
+		return h.checkURL(o.FallbackURL)
+	}
+	return nil
+}
+
+func writeURLErrors(w http.ResponseWriter, r *http.Request, errs ...URLError) {
+	respJSON, err := json.Marshal(URLErrorResponse{Errors: errs, RequestID: requestid.FromContext(r.Context())})
+	if err != nil {
+		http.Error(w, "Could not encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	writeResponse(w, respJSON)
+}
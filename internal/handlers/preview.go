@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"github.com/repriest/url-shortener/internal/logger"
+	t "github.com/repriest/url-shortener/internal/storage/types"
+	"go.uber.org/zap"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// lookupPreview looks up id like lookup and reports whether the "+" that
+// asks for a preview was stripped from it. Base64 codes may themselves end
+// with "+", so a stored code matching id wins.
+func (h *Handler) lookupPreview(ctx context.Context, id string) (t.URLEntry, bool, error) {
+	code, ok := strings.CutSuffix(id, "+")
+	if !ok || code == "" {
+		entry, err := h.lookup(ctx, id)
+		return entry, false, err
+	}
+	entry, err := h.st.Get(ctx, id)
+	if !errors.Is(err, t.ErrNotFound) {
+		return entry, false, err
+	}
+	entry, err = h.lookup(ctx, code)
+	return entry, true, err
+}
+
+// renderPreview shows where the link leads instead of redirecting. The click
+// count of stored links is left out if it cannot be read.
+func (h *Handler) renderPreview(w http.ResponseWriter, r *http.Request, entry t.URLEntry, destination string) {
+	host := destination
+	if u, err := url.Parse(destination); err == nil && u.Host != "" {
+		host = u.Hostname()
+	}
+	var clicks int64
+	if entry.UUID != "" {
+		counts, err := h.st.Clicks(r.Context(), entry.ShortURL)
+		if err != nil {
+			logger.FromContext(r.Context()).Warn("could not read clicks", zap.String("short_url", entry.ShortURL), zap.Error(err))
+		}
+		for _, count := range counts {
+			clicks += count
+		}
+	}
+	renderPage(w, r, http.StatusOK, "preview.html", struct {
+		ShortURL    string
+		Destination string
+		Host        string
+		CreatedAt   time.Time
+		Clicks      int64
+	}{h.cfg.BaseURL + "/" + entry.ShortURL, destination, host, entry.CreatedAt, clicks})
+}
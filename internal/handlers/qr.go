@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/repriest/url-shortener/internal/metrics"
+	"github.com/repriest/url-shortener/internal/qr"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultQRSize   = 256
+	minQRSize       = 64
+	maxQRSize       = 2048
+	defaultQRMargin = 4
+	maxQRMargin     = 16
+)
+
+// qrParams are the rendering options of a QR code request.
+type qrParams struct {
+	format string
+	opts   qr.Options
+}
+
+// QRHandler renders a QR code of the short URL. The code only depends on the
+// short URL and the rendering options, so it is cached by ETag and can be
+// printed without asking the server again.
+func (h *Handler) QRHandler(w http.ResponseWriter, r *http.Request) {
+	entry, err := h.lookup(r.Context(), chi.URLParam(r, "id"))
+	if errors.Is(err, errNotDecodable) || errors.Is(err, errRejected) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		writeLookupError(w, r, err)
+		return
+	}
+	if entry.Disabled {
+		writeDisabled(w, r, entry.ShortURL)
+		return
+	}
+	params, err := parseQRParams(r)
+	if err != nil {
+		http.Error(w, "Invalid QR code options: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	content := h.cfg.BaseURL + "/" + entry.ShortURL
+	etag := params.etag(content)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	hit := r.Header.Get("If-None-Match") == etag
+	metrics.CacheResult("qr", hit)
+	if hit {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	var img []byte
+	if params.format == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		img, err = qr.SVG(content, params.opts)
+	} else {
+		w.Header().Set("Content-Type", "image/png")
+		img, err = qr.PNG(content, params.opts)
+	}
+	if err != nil {
+		w.Header().Del("ETag")
+		w.Header().Del("Cache-Control")
+		w.Header().Del("Content-Type")
+		http.Error(w, "Could not render QR code", http.StatusInternalServerError)
+		return
+	}
+	writeResponse(w, img)
+}
+
+// shortenResponse returns the response for a shortened link, with the URL
+// of its QR code if withQR is set.
+func (h *Handler) shortenResponse(shortURL string, withQR bool) ShortenResponse {
+	resp := ShortenResponse{Result: h.cfg.BaseURL + "/" + shortURL}
+	if withQR {
+		resp.QR = resp.Result + "/qr"
+	}
+	return resp
+}
+
+func parseQRParams(r *http.Request) (qrParams, error) {
+	q := r.URL.Query()
+	p := qrParams{
+		format: "png",
+		opts: qr.Options{
+			Size:   defaultQRSize,
+			Level:  "M",
+			Margin: defaultQRMargin,
+		},
+	}
+
+	if v := q.Get("format"); v != "" {
+		if v != "png" && v != "svg" {
+			return qrParams{}, errors.New("format must be png or svg")
+		}
+		p.format = v
+	}
+	if v := q.Get("size"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil || size < minQRSize || size > maxQRSize {
+			return qrParams{}, fmt.Errorf("size must be between %d and %d", minQRSize, maxQRSize)
+		}
+		p.opts.Size = size
+	}
+	if v := q.Get("level"); v != "" {
+		v = strings.ToUpper(v)
+		if _, ok := qr.Levels[v]; !ok {
+			return qrParams{}, errors.New("level must be one of L, M, Q or H")
+		}
+		p.opts.Level = v
+	}
+	if v := q.Get("margin"); v != "" {
+		margin, err := strconv.Atoi(v)
+		if err != nil || margin < 0 || margin > maxQRMargin {
+			return qrParams{}, fmt.Errorf("margin must be between 0 and %d", maxQRMargin)
+		}
+		p.opts.Margin = margin
+	}
+
+	var err error
+	if p.opts.Foreground, err = qr.ParseColor(cmp.Or(q.Get("fg"), "000000")); err != nil {
+		return qrParams{}, err
+	}
+	if p.opts.Background, err = qr.ParseColor(cmp.Or(q.Get("bg"), "ffffff")); err != nil {
+		return qrParams{}, err
+	}
+	return p, nil
+}
+
+// etag identifies the image of content rendered with p.
+func (p qrParams) etag(content string) string {
+	o := p.opts
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%d\x00%s\x00%d\x00%v\x00%v",
+		content, p.format, o.Size, o.Level, o.Margin, o.Foreground, o.Background)))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
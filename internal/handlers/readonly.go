@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// WriteGuard refuses requests with 503 while the server is read-only.
+func (h *Handler) WriteGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if active, _, retryAfter := h.ro.Active(); active {
+			writeReadOnly(w, retryAfter)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (h *Handler) ReadOnlyStatusHandler(w http.ResponseWriter, r *http.Request) {
+	h.writeReadOnlyStatus(w)
+}
+
+// SetReadOnlyHandler turns planned maintenance mode on or off.
+func (h *Handler) SetReadOnlyHandler(w http.ResponseWriter, r *http.Request) {
+	var req ReadOnlyRequest
+
+	body, err := readRequestBody(r)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Reason == "" {
+		req.Reason = "planned maintenance"
+	}
+
+	h.ro.SetMaintenance(req.Enabled, req.Reason)
+	h.writeReadOnlyStatus(w)
+}
+
+func (h *Handler) writeReadOnlyStatus(w http.ResponseWriter) {
+	active, reason, retryAfter := h.ro.Active()
+	resp := ReadOnlyResponse{ReadOnly: active, Reason: reason}
+	if active {
+		resp.RetryAfter = retryAfterSeconds(retryAfter)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	respJSON, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, "Could not encode response", http.StatusInternalServerError)
+		return
+	}
+	writeResponse(w, respJSON)
+}
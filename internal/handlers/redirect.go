@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/repriest/url-shortener/internal/config"
+	"github.com/repriest/url-shortener/internal/logger"
+	"github.com/repriest/url-shortener/internal/rules"
+	t "github.com/repriest/url-shortener/internal/storage/types"
+	"github.com/repriest/url-shortener/internal/urlservice"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errSuffixNotAllowed = errors.New("link does not forward path suffixes")
+
+// errNotDecodable is returned by lookup for codes that are neither stored
+// nor encode a URL.
+var errNotDecodable = errors.New("short url is not stored and cannot be decoded")
+
+// errRejected is returned by lookup for decoded URLs that the URL policy or
+// the blocklist rejects.
+var errRejected = errors.New("decoded url is not allowed")
+
+// lookup finds the entry for shortURL. Codes that are not in storage are
+// decoded directly, so redirects keep working with default settings. Any
+// other storage error is returned, as a stored link may be protected,
+// disabled or redirect elsewhere.
+func (h *Handler) lookup(ctx context.Context, shortURL string) (t.URLEntry, error) {
+	entry, err := h.st.Get(ctx, shortURL)
+	if !errors.Is(err, t.ErrNotFound) {
+		return entry, err
+	}
+
+	longURL, err := urlservice.ExpandURL(shortURL)
+	if err != nil {
+		return t.URLEntry{}, errNotDecodable
+	}
+	// decoded URLs were never checked when shortening
+	if urlErr := h.checkURL(longURL); urlErr != nil {
+		logger.FromContext(ctx).Warn("decoded url rejected", zap.String("short_url", shortURL), zap.String("code", urlErr.Code))
+		return t.URLEntry{}, errRejected
+	}
+	return t.URLEntry{ShortURL: shortURL, OriginalURL: longURL}, nil
+}
+
+// writeLookupError reports why lookup failed.
+func writeLookupError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errNotDecodable) {
+		http.Error(w, "Could not decode URL", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, errRejected) {
+		renderPage(w, r, http.StatusForbidden, "blocked.html", nil)
+		return
+	}
+	logger.FromContext(r.Context()).Warn("could not look up url", zap.Error(err))
+	http.Error(w, "Storage temporarily unavailable", http.StatusServiceUnavailable)
+}
+
+// pickTarget points entry.OriginalURL at the destination for this request:
+// the first matching rule, otherwise a weighted variant, otherwise the
+// original URL, or its fallback while the original is failing. It returns
+// the rule index (-1 if none) and the variant.
+func (h *Handler) pickTarget(w http.ResponseWriter, r *http.Request, entry *t.URLEntry) (int, *t.Destination) {
+	if entry.FailedOver && entry.FallbackURL != "" {
+		entry.OriginalURL = entry.FallbackURL
+	}
+	if rule := rules.Evaluate(entry.Rules, h.ruleInput(r.Header)); rule >= 0 {
+		entry.OriginalURL = entry.Rules[rule].Destination
+		return rule, nil
+	}
+	variant := pickVariant(w, r, *entry)
+	if variant != nil {
+		entry.OriginalURL = variant.URL
+	}
+	return -1, variant
+}
+
+// setCacheHeaders lets clients cache permanent redirects. Tracked links,
+// links that pick destinations per request and temporary redirects must
+// reach the server on every visit.
+func (h *Handler) setCacheHeaders(w http.ResponseWriter, entry t.URLEntry, code int) {
+	switch {
+	case entry.Tracked || len(entry.Destinations) > 0 || len(entry.Rules) > 0 ||
+		entry.AppLink != nil || entry.PasswordHash != "" || entry.FallbackURL != "":
+		w.Header().Set("Cache-Control", "no-store")
+	case code == http.StatusMovedPermanently || code == http.StatusPermanentRedirect:
+		maxAge := h.cfg.RedirectCacheMaxAge
+		w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(maxAge.Seconds())))
+		w.Header().Set("Expires", time.Now().Add(maxAge).UTC().Format(http.TimeFormat))
+	default:
+		w.Header().Set("Cache-Control", "private, no-cache")
+	}
+}
+
+func (o LinkOptions) validate() error {
+	if o.RedirectCode != 0 && !config.ValidRedirectCode(o.RedirectCode) {
+		return fmt.Errorf("invalid redirect code %d", o.RedirectCode)
+	}
+	switch o.QueryPrecedence {
+	case "", urlservice.QueryPrecedenceDestination, urlservice.QueryPrecedenceRequest:
+	default:
+		return fmt.Errorf("invalid query precedence %q", o.QueryPrecedence)
+	}
+	// bcrypt ignores anything past 72 bytes
+	if len(o.Password) > 72 {
+		return errors.New("password is longer than 72 bytes")
+	}
+	if err := validateMetadata(o.Metadata); err != nil {
+		return fmt.Errorf("invalid metadata: %w", err)
+	}
+	if o.FallbackURL != "" && !isWebURL(o.FallbackURL) {
+		return errors.New("fallback url must be an absolute http or https URL")
+	}
+	if o.AppLink != nil {
+		return validateAppLink(*o.AppLink)
+	}
+	return nil
+}
+
+func (o LinkOptions) apply(entry *t.URLEntry) error {
+	entry.RedirectCode = o.RedirectCode
+	entry.Tracked = o.Tracked
+	entry.ForwardQuery = o.ForwardQuery
+	entry.QueryPrecedence = o.QueryPrecedence
+	entry.ForwardPath = o.ForwardPath
+	entry.AppLink = o.AppLink
+	entry.Interstitial = o.Interstitial
+	entry.FallbackURL = o.FallbackURL
+	entry.Metadata = o.Metadata
+	if o.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(o.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return fmt.Errorf("failed to hash password: %w", err)
+		}
+		entry.PasswordHash = string(hash)
+	}
+	return nil
+}
+
+// destination returns where the request should be redirected, with the
+// path suffix and query forwarded if the link allows it.
+func destination(r *http.Request, entry t.URLEntry) (string, error) {
+	// everything after the short code, still escaped
+	_, suffix, _ := strings.Cut(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/")
+	if suffix != "" && !entry.ForwardPath {
+		return "", errSuffixNotAllowed
+	}
+
+	return urlservice.Forward(entry.OriginalURL, suffix, r.URL.RawQuery, urlservice.ForwardOptions{
+		Query:           entry.ForwardQuery,
+		QueryPrecedence: entry.QueryPrecedence,
+		Path:            entry.ForwardPath,
+	})
+}
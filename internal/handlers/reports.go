@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/repriest/url-shortener/internal/logger"
+	t "github.com/repriest/url-shortener/internal/storage/types"
+	"go.uber.org/zap"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+var reportReasons = []string{"phishing", "malware", "spam", "illegal", "other"}
+
+const maxReportComment = 2000
+
+// ReportHandler files an abuse report about a short link. The link may be
+// given as a full short URL or as its code.
+func (h *Handler) ReportHandler(w http.ResponseWriter, r *http.Request) {
+	rs, ok := storageAs[t.ReportStorage](h.st)
+	if !ok {
+		http.Error(w, "Reports are not supported by storage", http.StatusConflict)
+		return
+	}
+
+	var req ReportRequest
+	body, err := readRequestBody(r)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if !slices.Contains(reportReasons, req.Reason) {
+		http.Error(w, "Reason must be one of "+strings.Join(reportReasons, ", "), http.StatusBadRequest)
+		return
+	}
+	if len(req.Comment) > maxReportComment {
+		http.Error(w, "Comment is too long", http.StatusBadRequest)
+		return
+	}
+
+	shortURL := strings.TrimPrefix(req.URL, h.cfg.BaseURL+"/")
+	if _, err := h.st.Get(r.Context(), shortURL); err != nil {
+		if errors.Is(err, t.ErrNotFound) {
+			http.Error(w, "URL not found", http.StatusNotFound)
+			return
+		}
+		h.writeStorageError(w, err, "Could not read URL from storage")
+		return
+	}
+
+	report := t.Report{
+		ID:            uuid.New().String(),
+		ShortURL:      shortURL,
+		Reason:        req.Reason,
+		Comment:       req.Comment,
+		ReporterEmail: req.Email,
+		ReporterIP:    clientIP(r),
+		ReporterAgent: r.UserAgent(),
+		Status:        t.ReportOpen,
+		CreatedAt:     time.Now().UTC(),
+	}
+	if err := rs.AddReport(r.Context(), report); err != nil {
+		h.writeStorageError(w, err, "Could not save report")
+		return
+	}
+	logger.FromContext(r.Context()).Info("link reported", zap.String("short_url", shortURL), zap.String("reason", req.Reason))
+
+	respJSON, err := json.Marshal(ReportResponse{ID: report.ID})
+	if err != nil {
+		http.Error(w, "Could not encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	writeResponse(w, respJSON)
+}
+
+// ReportsHandler lists reports, the open ones by default. status=all lists
+// every report.
+func (h *Handler) ReportsHandler(w http.ResponseWriter, r *http.Request) {
+	rs, ok := storageAs[t.ReportStorage](h.st)
+	if !ok {
+		http.Error(w, "Reports are not supported by storage", http.StatusConflict)
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "":
+		status = t.ReportOpen
+	case "all":
+		status = ""
+	case t.ReportOpen, t.ReportActioned, t.ReportDismissed:
+	default:
+		http.Error(w, "Invalid status", http.StatusBadRequest)
+		return
+	}
+
+	reports, err := rs.Reports(r.Context(), status)
+	if err != nil {
+		h.writeStorageError(w, err, "Could not read reports")
+		return
+	}
+	writeJSON(w, reports)
+}
+
+// DisableLinkHandler takes a link down and closes its open reports.
+func (h *Handler) DisableLinkHandler(w http.ResponseWriter, r *http.Request) {
+	h.moderate(w, r, true, t.ReportActioned)
+}
+
+// EnableLinkHandler restores a disabled link.
+func (h *Handler) EnableLinkHandler(w http.ResponseWriter, r *http.Request) {
+	h.moderate(w, r, false, "")
+}
+
+// DismissReportsHandler closes the open reports of a link without acting on it.
+func (h *Handler) DismissReportsHandler(w http.ResponseWriter, r *http.Request) {
+	rs, ok := storageAs[t.ReportStorage](h.st)
+	if !ok {
+		http.Error(w, "Reports are not supported by storage", http.StatusConflict)
+		return
+	}
+	entry, ok := h.getEntry(w, r)
+	if !ok {
+		return
+	}
+
+	resolved, err := rs.ResolveReports(r.Context(), entry.ShortURL, t.ReportDismissed)
+	if err != nil {
+		h.writeStorageError(w, err, "Could not update reports")
+		return
+	}
+	writeJSON(w, ModerationResponse{ShortURL: entry.ShortURL, Disabled: entry.Disabled, Resolved: resolved})
+}
+
+// moderate sets the disabled flag of a link. Reports are resolved with
+// status when it is not empty and storage keeps reports.
+func (h *Handler) moderate(w http.ResponseWriter, r *http.Request, disabled bool, status string) {
+	var req ModerationRequest
+	body, err := readRequestBody(r)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	}
+
+	entry, ok := h.getEntry(w, r)
+	if !ok {
+		return
+	}
+	entry.Disabled = disabled
+	entry.DisabledReason = ""
+	if disabled {
+		entry.DisabledReason = req.Reason
+	}
+	if err := h.st.Update(r.Context(), entry); err != nil {
+		h.writeStorageError(w, err, "Could not write URL to storage")
+		return
+	}
+	logger.FromContext(r.Context()).Info("link moderated", zap.String("short_url", entry.ShortURL), zap.Bool("disabled", disabled), zap.String("reason", req.Reason))
+
+	resp := ModerationResponse{ShortURL: entry.ShortURL, Disabled: disabled}
+	if rs, ok := storageAs[t.ReportStorage](h.st); ok && status != "" {
+		resp.Resolved, err = rs.ResolveReports(r.Context(), entry.ShortURL, status)
+		if err != nil {
+			h.writeStorageError(w, err, "Could not update reports")
+			return
+		}
+	}
+	writeJSON(w, resp)
+}
+
+// writeDisabled tells visitors that a moderator took the link down.
+func writeDisabled(w http.ResponseWriter, r *http.Request, shortURL string) {
+	logger.FromContext(r.Context()).Info("disabled link visited", zap.String("short_url", shortURL))
+	renderPage(w, r, http.StatusUnavailableForLegalReasons, "disabled.html", nil)
+}
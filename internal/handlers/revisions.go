@@ -0,0 +1,208 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/repriest/url-shortener/internal/config"
+	t "github.com/repriest/url-shortener/internal/storage/types"
+	"maps"
+	"net/http"
+	"time"
+)
+
+const (
+	maxMetadataKeys   = 32
+	maxMetadataKey    = 64
+	maxMetadataValue  = 1024
+	adminRevisionUser = "admin"
+)
+
+// EditURLHandler changes the destination, redirect code or metadata of a
+// link. Every change is recorded as a revision.
+func (h *Handler) EditURLHandler(w http.ResponseWriter, r *http.Request) {
+	var req EditURLRequest
+	body, err := readRequestBody(r)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.URL == nil && req.RedirectCode == nil && req.Metadata == nil {
+		http.Error(w, "Nothing to change", http.StatusBadRequest)
+		return
+	}
+	if req.RedirectCode != nil && *req.RedirectCode != 0 && !config.ValidRedirectCode(*req.RedirectCode) {
+		http.Error(w, fmt.Sprintf("Invalid redirect code %d", *req.RedirectCode), http.StatusBadRequest)
+		return
+	}
+	if req.Metadata != nil {
+		if err := validateMetadata(*req.Metadata); err != nil {
+			http.Error(w, "Invalid metadata: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	entry, ok := h.editableEntry(w, r)
+	if !ok {
+		return
+	}
+
+	v := entry.Version()
+	if req.URL != nil {
+		if v.OriginalURL, err = h.canonicalize(*req.URL); err != nil {
+			http.Error(w, "Invalid URL", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.RedirectCode != nil {
+		v.RedirectCode = *req.RedirectCode
+	}
+	if req.Metadata != nil {
+		v.Metadata = *req.Metadata
+	}
+	h.revise(w, r, entry, v)
+}
+
+// URLHistoryHandler lists the revisions of a link, oldest first.
+func (h *Handler) URLHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	rs, ok := storageAs[t.RevisionStorage](h.st)
+	if !ok {
+		http.Error(w, "History is not supported by storage", http.StatusConflict)
+		return
+	}
+	entry, ok := h.editableEntry(w, r)
+	if !ok {
+		return
+	}
+
+	revisions, err := rs.Revisions(r.Context(), entry.ShortURL)
+	if err != nil {
+		h.writeStorageError(w, err, "Could not read history")
+		return
+	}
+	writeJSON(w, revisions)
+}
+
+// RollbackURLHandler restores a link to an earlier version. The rollback is
+// recorded as a new revision, so it can be undone in turn.
+func (h *Handler) RollbackURLHandler(w http.ResponseWriter, r *http.Request) {
+	rs, ok := storageAs[t.RevisionStorage](h.st)
+	if !ok {
+		http.Error(w, "History is not supported by storage", http.StatusConflict)
+		return
+	}
+
+	var req RollbackRequest
+	body, err := readRequestBody(r)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Version == nil {
+		http.Error(w, "Version is required", http.StatusBadRequest)
+		return
+	}
+
+	entry, ok := h.editableEntry(w, r)
+	if !ok {
+		return
+	}
+	revisions, err := rs.Revisions(r.Context(), entry.ShortURL)
+	if err != nil {
+		h.writeStorageError(w, err, "Could not read history")
+		return
+	}
+
+	var v t.LinkVersion
+	switch n := *req.Version; {
+	case n == 0 && len(revisions) > 0:
+		v = revisions[0].Old
+	case n > 0 && n <= len(revisions):
+		v = revisions[n-1].New
+	default:
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	}
+	h.revise(w, r, entry, v)
+}
+
+// editableEntry returns the link of the request if the client may edit it.
+func (h *Handler) editableEntry(w http.ResponseWriter, r *http.Request) (t.URLEntry, bool) {
+	entry, ok := h.getEntry(w, r)
+	if !ok {
+		return t.URLEntry{}, false
+	}
+	if !h.canEdit(r, entry) {
+		http.Error(w, "Only the owner can change this URL", http.StatusForbidden)
+		return t.URLEntry{}, false
+	}
+	return entry, true
+}
+
+// revise sets the editable fields of entry to v and records the change.
+func (h *Handler) revise(w http.ResponseWriter, r *http.Request, entry t.URLEntry, v t.LinkVersion) {
+	rs, ok := storageAs[t.RevisionStorage](h.st)
+	if !ok {
+		http.Error(w, "History is not supported by storage", http.StatusConflict)
+		return
+	}
+
+	old := entry.Version()
+	if v.OriginalURL == old.OriginalURL && v.RedirectCode == old.RedirectCode && maps.Equal(v.Metadata, old.Metadata) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if v.OriginalURL != old.OriginalURL {
+		if urlErr := h.checkURL(v.OriginalURL); urlErr != nil {
+			writeURLErrors(w, r, *urlErr)
+			return
+		}
+		// health checks start over for the new destination
+		entry.FailedOver = false
+	}
+
+	author := userID(r)
+	if author == "" || author != entry.OwnerID && h.isAdmin(r) {
+		author = adminRevisionUser
+	}
+	entry.SetVersion(v)
+	rev, err := rs.Revise(r.Context(), entry, t.Revision{
+		Author:    author,
+		CreatedAt: time.Now().UTC(),
+		Old:       old,
+		New:       v,
+	})
+	var conflictErr *t.URLConflictError
+	if errors.As(err, &conflictErr) {
+		http.Error(w, "Destination is already shortened", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		h.writeStorageError(w, err, "Could not write URL to storage")
+		return
+	}
+	writeJSON(w, rev)
+}
+
+func validateMetadata(metadata map[string]string) error {
+	if len(metadata) > maxMetadataKeys {
+		return fmt.Errorf("at most %d keys are allowed", maxMetadataKeys)
+	}
+	for k, v := range metadata {
+		if k == "" || len(k) > maxMetadataKey {
+			return fmt.Errorf("keys must be 1 to %d bytes long", maxMetadataKey)
+		}
+		if len(v) > maxMetadataValue {
+			return fmt.Errorf("value of %s is longer than %d bytes", k, maxMetadataValue)
+		}
+	}
+	return nil
+}
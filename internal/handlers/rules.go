@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/repriest/url-shortener/internal/rules"
+	t "github.com/repriest/url-shortener/internal/storage/types"
+	"github.com/repriest/url-shortener/internal/useragent"
+	"net/http"
+	"time"
+)
+
+func (h *Handler) GetRulesHandler(w http.ResponseWriter, r *http.Request) {
+	entry, ok := h.getEntry(w, r)
+	if !ok {
+		return
+	}
+	writeRules(w, entry)
+}
+
+// SetRulesHandler replaces the redirect rules of a link. An empty list
+// removes them.
+func (h *Handler) SetRulesHandler(w http.ResponseWriter, r *http.Request) {
+	var req RulesRequest
+
+	body, err := readRequestBody(r)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if err := rules.Validate(req.Rules); err != nil {
+		http.Error(w, "Invalid rules: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	urls := make([]string, len(req.Rules))
+	for i, rule := range req.Rules {
+		urls[i] = rule.Destination
+	}
+	if urlErrs := h.checkURLs(urls...); len(urlErrs) > 0 {
+		writeURLErrors(w, r, urlErrs...)
+		return
+	}
+
+	entry, ok := h.getEntry(w, r)
+	if !ok {
+		return
+	}
+	entry.Rules = req.Rules
+	if err := h.st.Update(r.Context(), entry); err != nil {
+		h.writeStorageError(w, err, "Could not write URL to storage")
+		return
+	}
+	writeRules(w, entry)
+}
+
+// TestRulesHandler reports which rule would fire for the given request
+// headers and time without redirecting.
+func (h *Handler) TestRulesHandler(w http.ResponseWriter, r *http.Request) {
+	var req RulesTestRequest
+
+	body, err := readRequestBody(r)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	entry, ok := h.getEntry(w, r)
+	if !ok {
+		return
+	}
+
+	header := make(http.Header)
+	for k, v := range req.Headers {
+		header.Set(k, v)
+	}
+	in := h.ruleInput(header)
+	if req.Time != nil {
+		in.Now = *req.Time
+	}
+
+	resp := RulesTestResponse{
+		Rule:        rules.Evaluate(entry.Rules, in),
+		Device:      useragent.Device(in.UserAgent),
+		Language:    rules.PreferredLanguage(in.AcceptLanguage),
+		Country:     in.Country,
+		Destination: entry.OriginalURL,
+		Variants:    len(entry.Destinations) > 0,
+	}
+	if resp.Rule >= 0 {
+		resp.RuleID = entry.Rules[resp.Rule].ID
+		resp.Destination = entry.Rules[resp.Rule].Destination
+		resp.Variants = false
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	respJSON, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, "Could not encode response", http.StatusInternalServerError)
+		return
+	}
+	writeResponse(w, respJSON)
+}
+
+func (h *Handler) ruleInput(header http.Header) rules.Input {
+	return rules.Input{
+		UserAgent:      header.Get("User-Agent"),
+		AcceptLanguage: header.Get("Accept-Language"),
+		Country:        header.Get(h.cfg.CountryHeader),
+		Now:            time.Now(),
+	}
+}
+
+// getEntry loads the stored entry for the {id} URL param, writing an error
+// response if there is none.
+func (h *Handler) getEntry(w http.ResponseWriter, r *http.Request) (t.URLEntry, bool) {
+	entry, err := h.st.Get(r.Context(), chi.URLParam(r, "id"))
+	if errors.Is(err, t.ErrNotFound) {
+		http.Error(w, "URL not found", http.StatusNotFound)
+		return t.URLEntry{}, false
+	}
+	if err != nil {
+		h.writeStorageError(w, err, "Could not read URL from storage")
+		return t.URLEntry{}, false
+	}
+	return entry, true
+}
+
+func writeRules(w http.ResponseWriter, entry t.URLEntry) {
+	resp := RulesRequest{Rules: entry.Rules}
+	if resp.Rules == nil {
+		resp.Rules = []t.Rule{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	respJSON, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, "Could not encode response", http.StatusInternalServerError)
+		return
+	}
+	writeResponse(w, respJSON)
+}
@@ -1,33 +1,251 @@
 package handlers
 
 import (
+	"crypto/rand"
+	"github.com/repriest/url-shortener/internal/blocklist"
 	"github.com/repriest/url-shortener/internal/config"
+	"github.com/repriest/url-shortener/internal/healthcheck"
+	"github.com/repriest/url-shortener/internal/ratelimit"
+	"github.com/repriest/url-shortener/internal/readonly"
 	t "github.com/repriest/url-shortener/internal/storage/types"
+	"github.com/repriest/url-shortener/internal/urlpolicy"
+	"time"
 )
 
 type Handler struct {
 	cfg *config.Config
 	st  t.Storage
+	ro  *readonly.Mode
+
+	// cookieKey signs unlock and user cookies, attempts limits password guessing
+	cookieKey []byte
+	attempts  *ratelimit.FailureLimiter
+	policy    *urlpolicy.Policy
+	blocklist *blocklist.Blocklist
 }
 
 func NewHandler(cfg *config.Config, st t.Storage) *Handler {
-	return &Handler{cfg: cfg, st: st}
+	cookieKey := []byte(cfg.LinkCookieSecret)
+	if len(cookieKey) == 0 {
+		cookieKey = []byte(rand.Text())
+	}
+	return &Handler{
+		cfg:       cfg,
+		st:        st,
+		ro:        readonly.NewMode(cfg.ReadOnlyRetryAfter),
+		cookieKey: cookieKey,
+		attempts:  ratelimit.NewFailureLimiter(cfg.PasswordMaxAttempts, cfg.PasswordLockout),
+		policy: urlpolicy.New(urlpolicy.Options{
+			Schemes:           cfg.AllowedSchemes,
+			MaxLength:         cfg.MaxURLLength,
+			BaseURL:           cfg.BaseURL,
+			AllowPrivateHosts: cfg.AllowPrivateHosts,
+			DomainListPath:    cfg.DomainListPath,
+			DomainListReload:  cfg.DomainListReloadInterval,
+		}),
+		blocklist: blocklist.New(blocklist.Options{
+			DomainsPath:      cfg.BlocklistDomainsPath,
+			HashPrefixesPath: cfg.BlocklistHashPrefixesPath,
+			Reload:           cfg.BlocklistReloadInterval,
+		}),
+	}
+}
+
+// LinkOptions are per-link settings accepted by the JSON shorten endpoints.
+type LinkOptions struct {
+	RedirectCode    int        `json:"redirect_code,omitempty"`
+	Tracked         bool       `json:"tracked,omitempty"`
+	ForwardQuery    bool       `json:"forward_query,omitempty"`
+	QueryPrecedence string     `json:"query_precedence,omitempty"`
+	ForwardPath     bool       `json:"forward_path,omitempty"`
+	AppLink         *t.AppLink `json:"app_link,omitempty"`
+	Password        string     `json:"password,omitempty"`
+	Interstitial    bool       `json:"interstitial,omitempty"`
+	// FallbackURL is used while health checks find the destination failing
+	FallbackURL string            `json:"fallback_url,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
 }
 
 type ShortenRequest struct {
 	URL string `json:"url"`
+	// QR adds the URL of the link's QR code to the response
+	QR bool `json:"qr,omitempty"`
+	LinkOptions
 }
 
 type ShortenResponse struct {
 	Result string `json:"result"`
+	QR     string `json:"qr,omitempty"`
 }
 
 type ShortenBatchRequest struct {
 	CorrelationID string `json:"correlation_id"`
 	OriginalURL   string `json:"original_url"`
+	LinkOptions
+}
+
+// URLError describes why a destination URL was rejected.
+type URLError struct {
+	Code          string `json:"code"`
+	Message       string `json:"message"`
+	URL           string `json:"url"`
+	CorrelationID string `json:"correlation_id,omitempty"`
+}
+
+type URLErrorResponse struct {
+	Errors    []URLError `json:"errors"`
+	RequestID string     `json:"request_id,omitempty"`
 }
 
 type ShortenBatchResponse struct {
 	CorrelationID string `json:"correlation_id"`
 	ShortURL      string `json:"short_url"`
 }
+
+// VariantsRequest is used both to set and to return a link's destinations.
+type VariantsRequest struct {
+	Sticky   bool            `json:"sticky"`
+	Variants []t.Destination `json:"variants"`
+}
+
+// RulesRequest is used both to set and to return a link's rules.
+type RulesRequest struct {
+	Rules []t.Rule `json:"rules"`
+}
+
+type RulesTestRequest struct {
+	Headers map[string]string `json:"headers"`
+	Time    *time.Time        `json:"time,omitempty"`
+}
+
+type RulesTestResponse struct {
+	// Rule is the index of the matching rule, -1 if the fallback is used
+	Rule        int    `json:"rule"`
+	RuleID      string `json:"rule_id,omitempty"`
+	Destination string `json:"destination"`
+	// Variants is set when the fallback rotates weighted destinations
+	Variants bool   `json:"variants,omitempty"`
+	Device   string `json:"device"`
+	Language string `json:"language,omitempty"`
+	Country  string `json:"country,omitempty"`
+}
+
+// AppleAppSiteAssociation is served as apple-app-site-association.
+type AppleAppSiteAssociation struct {
+	AppLinks AppleAppLinks `json:"applinks"`
+}
+
+type AppleAppLinks struct {
+	Apps    []string          `json:"apps"`
+	Details []AppleAppDetails `json:"details"`
+}
+
+type AppleAppDetails struct {
+	AppID string   `json:"appID"`
+	Paths []string `json:"paths"`
+}
+
+// AssetLink is an entry of assetlinks.json.
+type AssetLink struct {
+	Relation []string        `json:"relation"`
+	Target   AssetLinkTarget `json:"target"`
+}
+
+type AssetLinkTarget struct {
+	Namespace              string   `json:"namespace"`
+	PackageName            string   `json:"package_name"`
+	SHA256CertFingerprints []string `json:"sha256_cert_fingerprints"`
+}
+
+// ReportRequest reports abuse of a short link, URL is the short URL or its code.
+type ReportRequest struct {
+	URL     string `json:"url"`
+	Reason  string `json:"reason"`
+	Comment string `json:"comment,omitempty"`
+	Email   string `json:"email,omitempty"`
+}
+
+type ReportResponse struct {
+	ID string `json:"id"`
+}
+
+type ModerationRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+type ModerationResponse struct {
+	ShortURL string `json:"short_url"`
+	Disabled bool   `json:"disabled"`
+	// Resolved is the number of open reports that were closed
+	Resolved int `json:"resolved"`
+}
+
+// EditURLRequest changes the fields that are set, a null or missing field
+// is left alone.
+type EditURLRequest struct {
+	URL          *string            `json:"url"`
+	RedirectCode *int               `json:"redirect_code"`
+	Metadata     *map[string]string `json:"metadata"`
+}
+
+type RollbackRequest struct {
+	Version *int `json:"version"`
+}
+
+// ExpandBatchResponse is the result for one short URL. The destination of
+// password-protected links is not revealed.
+type ExpandBatchResponse struct {
+	ShortURL          string `json:"short_url"`
+	OriginalURL       string `json:"original_url,omitempty"`
+	Status            string `json:"status"`
+	PasswordProtected bool   `json:"password_protected,omitempty"`
+}
+
+type LookupResponse struct {
+	URL   string       `json:"url"`
+	Links []LookupLink `json:"links"`
+}
+
+type LookupLink struct {
+	ShortCode string `json:"short_code"`
+	ShortURL  string `json:"short_url"`
+}
+
+// URLInfoResponse describes a link. Links do not expire, so there is no
+// expiry to report.
+type URLInfoResponse struct {
+	ShortCode   string    `json:"short_code"`
+	ShortURL    string    `json:"short_url"`
+	OriginalURL string    `json:"original_url,omitempty"`
+	CreatedAt   time.Time `json:"created_at,omitzero"`
+	// OwnerID is only shown to the owner and admins
+	OwnerID           string            `json:"owner_id,omitempty"`
+	RedirectCode      int               `json:"redirect_code"`
+	Clicks            int64             `json:"clicks"`
+	VariantClicks     map[string]int64  `json:"variant_clicks,omitempty"`
+	PasswordProtected bool              `json:"password_protected,omitempty"`
+	Disabled          bool              `json:"disabled,omitempty"`
+	Metadata          map[string]string `json:"metadata,omitempty"`
+}
+
+type LinkHealthResponse struct {
+	ShortURL    string `json:"short_url"`
+	FallbackURL string `json:"fallback_url,omitempty"`
+	FailedOver  bool   `json:"failed_over"`
+	healthcheck.Health
+}
+
+type ReadOnlyRequest struct {
+	Enabled bool   `json:"enabled"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+type ReadOnlyResponse struct {
+	ReadOnly   bool   `json:"read_only"`
+	Reason     string `json:"reason,omitempty"`
+	RetryAfter int    `json:"retry_after,omitempty"`
+}
+
+type RotateKeysResponse struct {
+	Rotated int `json:"rotated"`
+}
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/google/uuid"
+	t "github.com/repriest/url-shortener/internal/storage/types"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	userCookieName = "user_id"
+	userCookieAge  = 365 * 24 * time.Hour
+)
+
+type userIDKey struct{}
+
+// Identify gives every client a user ID in a signed cookie. Links are owned
+// by the user ID that created them.
+func (h *Handler) Identify(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := h.cookieUserID(r)
+		if !ok {
+			id = uuid.New().String()
+			http.SetCookie(w, &http.Cookie{
+				Name:     userCookieName,
+				Value:    id + "." + h.signUser(id),
+				Path:     "/",
+				MaxAge:   int(userCookieAge.Seconds()),
+				HttpOnly: true,
+				Secure:   r.TLS != nil || strings.HasPrefix(h.cfg.BaseURL, "https://"),
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userIDKey{}, id)))
+	})
+}
+
+// userID returns the ID set by Identify, empty outside of it.
+func userID(r *http.Request) string {
+	id, _ := r.Context().Value(userIDKey{}).(string)
+	return id
+}
+
+func (h *Handler) cookieUserID(r *http.Request) (string, bool) {
+	c, err := r.Cookie(userCookieName)
+	if err != nil {
+		return "", false
+	}
+	id, sig, ok := strings.Cut(c.Value, ".")
+	if !ok || id == "" {
+		return "", false
+	}
+	return id, hmac.Equal([]byte(sig), []byte(h.signUser(id)))
+}
+
+func (h *Handler) signUser(id string) string {
+	mac := hmac.New(sha256.New, h.cookieKey)
+	mac.Write([]byte("user\x00" + id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// canEdit reports whether r may change entry: the owner and admins can,
+// links created without an owner can only be changed by admins.
+func (h *Handler) canEdit(r *http.Request, entry t.URLEntry) bool {
+	if h.isAdmin(r) {
+		return true
+	}
+	return entry.OwnerID != "" && entry.OwnerID == userID(r)
+}
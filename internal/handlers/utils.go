@@ -1,8 +1,14 @@
 package handlers
 
 import (
+	"encoding/json"
+	"errors"
+	t "github.com/repriest/url-shortener/internal/storage/types"
 	"io"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 func readRequestBody(r *http.Request) ([]byte, error) {
@@ -20,6 +26,16 @@ func writeResponse(w http.ResponseWriter, content []byte) {
 	}
 }
 
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	respJSON, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "Could not encode response", http.StatusInternalServerError)
+		return
+	}
+	writeResponse(w, respJSON)
+}
+
 func getLongURL(r *http.Request) (string, error) {
 	body, err := readRequestBody(r)
 	if err != nil {
@@ -27,3 +43,36 @@ func getLongURL(r *http.Request) (string, error) {
 	}
 	return string(body), nil
 }
+
+// writeStorageError reports a storage failure, telling the client to retry
+// later when storage is temporarily unavailable or has become read-only.
+func (h *Handler) writeStorageError(w http.ResponseWriter, err error, msg string) {
+	if errors.Is(err, t.ErrReadOnly) {
+		h.ro.Trip(err.Error())
+		writeReadOnly(w, h.cfg.ReadOnlyRetryAfter)
+		return
+	}
+	if errors.Is(err, t.ErrUnavailable) {
+		http.Error(w, "Storage temporarily unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(err, errors.ErrUnsupported) {
+		http.Error(w, "Not supported by storage", http.StatusConflict)
+		return
+	}
+	http.Error(w, msg, http.StatusInternalServerError)
+}
+
+func writeReadOnly(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(retryAfter)))
+	http.Error(w, "Service is read-only, try again later", http.StatusServiceUnavailable)
+}
+
+func retryAfterSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// storageAs finds a storage of type T in the chain of storage wrappers.
+func storageAs[T any](st t.Storage) (T, bool) {
+	return t.As[T](st)
+}
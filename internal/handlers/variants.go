@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/repriest/url-shortener/internal/logger"
+	t "github.com/repriest/url-shortener/internal/storage/types"
+	"go.uber.org/zap"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+)
+
+const (
+	maxVariants      = 100
+	maxVariantWeight = 1_000_000
+	variantCookieAge = 30 * 24 * time.Hour
+)
+
+var variantIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+func (h *Handler) GetVariantsHandler(w http.ResponseWriter, r *http.Request) {
+	entry, ok := h.getEntry(w, r)
+	if !ok {
+		return
+	}
+	writeVariants(w, entry)
+}
+
+// SetVariantsHandler replaces the weighted destinations of a link. An empty
+// list turns rotation off.
+func (h *Handler) SetVariantsHandler(w http.ResponseWriter, r *http.Request) {
+	var req VariantsRequest
+
+	body, err := readRequestBody(r)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if err := validateVariants(req.Variants); err != nil {
+		http.Error(w, "Invalid variants: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	urls := make([]string, len(req.Variants))
+	for i, v := range req.Variants {
+		urls[i] = v.URL
+	}
+	if urlErrs := h.checkURLs(urls...); len(urlErrs) > 0 {
+		writeURLErrors(w, r, urlErrs...)
+		return
+	}
+
+	entry, ok := h.getEntry(w, r)
+	if !ok {
+		return
+	}
+
+	entry.Destinations = req.Variants
+	entry.Sticky = req.Sticky
+	if err := h.st.Update(r.Context(), entry); err != nil {
+		h.writeStorageError(w, err, "Could not write URL to storage")
+		return
+	}
+	writeVariants(w, entry)
+}
+
+func writeVariants(w http.ResponseWriter, entry t.URLEntry) {
+	resp := VariantsRequest{Sticky: entry.Sticky, Variants: entry.Destinations}
+	if resp.Variants == nil {
+		resp.Variants = []t.Destination{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	respJSON, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, "Could not encode response", http.StatusInternalServerError)
+		return
+	}
+	writeResponse(w, respJSON)
+}
+
+func validateVariants(variants []t.Destination) error {
+	if len(variants) > maxVariants {
+		return fmt.Errorf("at most %d variants are allowed", maxVariants)
+	}
+	seen := make(map[string]bool)
+	for _, v := range variants {
+		if !variantIDPattern.MatchString(v.ID) {
+			return fmt.Errorf("invalid id %q", v.ID)
+		}
+		if seen[v.ID] {
+			return fmt.Errorf("duplicate id %q", v.ID)
+		}
+		seen[v.ID] = true
+		if _, err := url.ParseRequestURI(v.URL); err != nil {
+			return fmt.Errorf("invalid url for %s", v.ID)
+		}
+		// bounded so the total weight of all variants cannot overflow
+		if v.Weight <= 0 || v.Weight > maxVariantWeight {
+			return fmt.Errorf("weight of %s must be between 1 and %d", v.ID, maxVariantWeight)
+		}
+	}
+	return nil
+}
+
+// pickVariant chooses a destination by weight, or returns nil if the link
+// has none. Sticky links reuse the variant remembered in a cookie.
+func pickVariant(w http.ResponseWriter, r *http.Request, entry t.URLEntry) *t.Destination {
+	if len(entry.Destinations) == 0 {
+		return nil
+	}
+
+	cookieName := linkCookieName("v_", entry.ShortURL)
+	if entry.Sticky {
+		if c, err := r.Cookie(cookieName); err == nil {
+			for i := range entry.Destinations {
+				if entry.Destinations[i].ID == c.Value {
+					return &entry.Destinations[i]
+				}
+			}
+		}
+	}
+
+	total := 0
+	for _, d := range entry.Destinations {
+		total += d.Weight
+	}
+	n := rand.IntN(total)
+	picked := &entry.Destinations[len(entry.Destinations)-1]
+	for i := range entry.Destinations {
+		n -= entry.Destinations[i].Weight
+		if n < 0 {
+			picked = &entry.Destinations[i]
+			break
+		}
+	}
+
+	if entry.Sticky {
+		http.SetCookie(w, &http.Cookie{
+			Name:     cookieName,
+			Value:    picked.ID,
+			Path:     "/",
+			MaxAge:   int(variantCookieAge.Seconds()),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	return picked
+}
+
+// linkCookieName derives a cookie name from the short code, which may
+// contain characters that are not allowed in cookie names.
+func linkCookieName(prefix, shortURL string) string {
+	sum := sha256.Sum256([]byte(shortURL))
+	return prefix + hex.EncodeToString(sum[:8])
+}
+
+func logClick(ctx context.Context, entry t.URLEntry, rule int, variant *t.Destination) {
+	fields := []zap.Field{zap.String("short_url", entry.ShortURL)}
+	if rule >= 0 {
+		fields = append(fields, zap.Int("rule", rule))
+	}
+	if variant != nil {
+		fields = append(fields, zap.String("variant", variant.ID))
+	}
+	logger.FromContext(ctx).Info("click", fields...)
+}
+
+// countClick counts a visit of a stored link by the variant served, if any.
+// Links that are only decoded from their code are not counted, nor are HEAD
+// requests. A failure to count does not fail the redirect.
+func (h *Handler) countClick(r *http.Request, entry t.URLEntry, variant *t.Destination) {
+	if entry.UUID == "" || r.Method == http.MethodHead {
+		return
+	}
+	variantID := ""
+	if variant != nil {
+		variantID = variant.ID
+	}
+	if err := h.st.AddClick(r.Context(), entry.ShortURL, variantID); err != nil {
+		logger.FromContext(r.Context()).Warn("could not count click", zap.String("short_url", entry.ShortURL), zap.Error(err))
+	}
+}
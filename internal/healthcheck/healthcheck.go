@@ -0,0 +1,368 @@
+package healthcheck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/repriest/url-shortener/internal/logger"
+	t "github.com/repriest/url-shortener/internal/storage/types"
+	"github.com/repriest/url-shortener/internal/urlpolicy"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var errPrivateAddress = errors.New("destination resolves to a private address")
+
+type Options struct {
+	// Interval between checks of all links, 0 only checks on CheckAll
+	Interval time.Duration
+	// Timeout of a single check
+	Timeout time.Duration
+	// Concurrency is the number of links checked at once
+	Concurrency int
+	// HostInterval is the minimum gap between requests to the same host
+	HostInterval time.Duration
+	// FailureThreshold is the number of consecutive failures after which a
+	// link with a fallback URL is switched to it, 0 never switches
+	FailureThreshold int
+	// HistorySize is the number of results kept per link
+	HistorySize int
+	// AllowPrivateHosts lets checks connect to loopback and private addresses
+	AllowPrivateHosts bool
+	// Client replaces the default HTTP client
+	Client *http.Client
+}
+
+// Result is the outcome of a single check.
+type Result struct {
+	Time      time.Time `json:"time"`
+	URL       string    `json:"url"`
+	Status    int       `json:"status,omitempty"`
+	LatencyMS int64     `json:"latency_ms"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// OK reports whether the destination answered with a non-error status.
+func (r Result) OK() bool {
+	return r.Error == "" && r.Status < http.StatusBadRequest
+}
+
+// Health is the check history of a link, oldest result first.
+type Health struct {
+	ConsecutiveFailures int      `json:"consecutive_failures"`
+	Results             []Result `json:"results"`
+}
+
+// Checker wraps a storage backend and periodically checks the destinations
+// of its active links. Links with a fallback URL are switched to it after
+// FailureThreshold consecutive failures and back once the original
+// destination answers again. History is kept in memory only.
+type Checker struct {
+	t.Storage
+
+	opts   Options
+	client *http.Client
+	hosts  *hostLimiter
+
+	mu      sync.Mutex
+	history map[string]*Health
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewChecker(st t.Storage, opts Options) *Checker {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+	if opts.HistorySize <= 0 {
+		opts.HistorySize = 1
+	}
+	client := opts.Client
+	if client == nil {
+		client = newClient(opts.AllowPrivateHosts)
+	}
+
+	c := &Checker{
+		Storage: st,
+		opts:    opts,
+		client:  client,
+		hosts:   &hostLimiter{gap: opts.HostInterval, next: make(map[string]time.Time)},
+		history: make(map[string]*Health),
+		cancel:  func() {},
+	}
+	if opts.Interval > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		c.cancel = cancel
+		c.wg.Add(1)
+		go c.run(ctx)
+	}
+	return c
+}
+
+// Unwrap returns the wrapped storage.
+func (c *Checker) Unwrap() t.Storage {
+	return c.Storage
+}
+
+// Close stops the checks and closes the wrapped storage.
+func (c *Checker) Close() error {
+	c.cancel()
+	c.wg.Wait()
+	return c.Storage.Close()
+}
+
+// Health returns the check history of shortURL.
+func (c *Checker) Health(shortURL string) (Health, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	h, ok := c.history[shortURL]
+	if !ok {
+		return Health{}, false
+	}
+	return Health{
+		ConsecutiveFailures: h.ConsecutiveFailures,
+		Results:             append([]Result(nil), h.Results...),
+	}, true
+}
+
+func (c *Checker) run(ctx context.Context) {
+	defer c.wg.Done()
+	ticker := time.NewTicker(c.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.CheckAll(ctx); err != nil && ctx.Err() == nil {
+				logger.Log.Error("could not check link health", zap.Error(err))
+			}
+		}
+	}
+}
+
+// CheckAll checks the destination of every link that is not disabled and
+// returns once all checks are done.
+func (c *Checker) CheckAll(ctx context.Context) error {
+	entries, err := c.Storage.Load(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load links: %w", err)
+	}
+
+	jobs := make(chan t.URLEntry)
+	var wg sync.WaitGroup
+	for range c.opts.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for entry := range jobs {
+				c.checkEntry(ctx, entry)
+			}
+		}()
+	}
+
+	active := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.Disabled || !checkable(entry.OriginalURL) {
+			continue
+		}
+		active[entry.ShortURL] = true
+		select {
+		case jobs <- entry:
+		case <-ctx.Done():
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	// forget links that were removed or disabled
+	c.mu.Lock()
+	for shortURL := range c.history {
+		if !active[shortURL] {
+			delete(c.history, shortURL)
+		}
+	}
+	c.mu.Unlock()
+
+	return nil
+}
+
+func (c *Checker) checkEntry(ctx context.Context, entry t.URLEntry) {
+	u, _ := url.Parse(entry.OriginalURL)
+	if err := c.hosts.wait(ctx, u.Host); err != nil {
+		return
+	}
+	res := c.check(ctx, entry.OriginalURL)
+	if ctx.Err() != nil {
+		return
+	}
+	failures := c.record(entry.ShortURL, res)
+
+	if entry.FallbackURL == "" || c.opts.FailureThreshold <= 0 {
+		return
+	}
+	// the link may have been edited while it was checked, so only the flag
+	// is written
+	fs, ok := t.As[t.FailoverStorage](c.Storage)
+	if !ok {
+		return
+	}
+	entry, err := c.Storage.Get(ctx, entry.ShortURL)
+	if err != nil || entry.FallbackURL == "" {
+		return
+	}
+	switch {
+	case !entry.FailedOver && failures >= c.opts.FailureThreshold:
+		entry.FailedOver = true
+		logger.Log.Warn("link destination is failing, switching to fallback",
+			zap.String("short_url", entry.ShortURL), zap.Int("failures", failures))
+	case entry.FailedOver && failures == 0:
+		entry.FailedOver = false
+		logger.Log.Info("link destination recovered", zap.String("short_url", entry.ShortURL))
+	default:
+		return
+	}
+	if err := fs.SetFailedOver(ctx, entry.ShortURL, entry.FailedOver); err != nil {
+		logger.Log.Error("could not update link", zap.String("short_url", entry.ShortURL), zap.Error(err))
+	}
+}
+
+// check requests rawURL with HEAD, falling back to GET for servers that do
+// not support HEAD.
+func (c *Checker) check(ctx context.Context, rawURL string) Result {
+	if c.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.Timeout)
+		defer cancel()
+	}
+
+	res := Result{Time: time.Now().UTC(), URL: rawURL}
+	start := time.Now()
+	status, err := c.request(ctx, http.MethodHead, rawURL)
+	if err == nil && (status == http.StatusMethodNotAllowed || status == http.StatusNotImplemented) {
+		status, err = c.request(ctx, http.MethodGet, rawURL)
+	}
+	res.LatencyMS = time.Since(start).Milliseconds()
+	res.Status = status
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+func (c *Checker) request(ctx context.Context, method, rawURL string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	// the body is not needed, closing it unread drops the connection
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// record adds res to the history of shortURL and returns the number of
+// consecutive failures.
+func (c *Checker) record(shortURL string, res Result) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	h, ok := c.history[shortURL]
+	if !ok {
+		h = &Health{}
+		c.history[shortURL] = h
+	}
+	h.Results = append(h.Results, res)
+	if len(h.Results) > c.opts.HistorySize {
+		h.Results = h.Results[len(h.Results)-c.opts.HistorySize:]
+	}
+	if res.OK() {
+		h.ConsecutiveFailures = 0
+	} else {
+		h.ConsecutiveFailures++
+	}
+	return h.ConsecutiveFailures
+}
+
+func checkable(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// newClient returns a client that does not connect to private addresses,
+// which a public host name may resolve to.
+func newClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{}
+	if !allowPrivate {
+		dialer.Control = func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if addr, err := netip.ParseAddr(host); err == nil && urlpolicy.IsPrivateAddr(addr) {
+				return errPrivateAddress
+			}
+			return nil
+		}
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			MaxIdleConnsPerHost: 1,
+		},
+	}
+}
+
+// hostLimiter spaces requests to the same host at least gap apart.
+type hostLimiter struct {
+	gap time.Duration
+
+	mu   sync.Mutex
+	next map[string]time.Time
+}
+
+// wait blocks until a request to host may be sent.
+func (l *hostLimiter) wait(ctx context.Context, host string) error {
+	if l.gap <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	at := l.next[host]
+	if at.Before(now) {
+		at = now
+	}
+	l.next[host] = at.Add(l.gap)
+	// drop hosts that are free again
+	for h, next := range l.next {
+		if next.Before(now) {
+			delete(l.next, h)
+		}
+	}
+	l.mu.Unlock()
+
+	timer := time.NewTimer(time.Until(at))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
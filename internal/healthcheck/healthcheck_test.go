@@ -0,0 +1,186 @@
+package healthcheck
+
+import (
+	"context"
+	"github.com/repriest/url-shortener/internal/storage/memory"
+	"github.com/repriest/url-shortener/internal/storage/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newStorage(t testing.TB, entries ...types.URLEntry) *memory.MemoryStorage {
+	st, err := memory.NewMemoryStorage()
+	require.NoError(t, err)
+	require.NoError(t, st.BatchAppend(context.Background(), entries))
+	return st
+}
+
+func TestFailover(t *testing.T) {
+	var down atomic.Bool
+	var methods []string
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		methods = append(methods, r.Method)
+		mu.Unlock()
+		switch {
+		case down.Load():
+			w.WriteHeader(http.StatusBadGateway)
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	defer srv.Close()
+
+	st := newStorage(t,
+		types.URLEntry{ShortURL: "a", OriginalURL: srv.URL + "/a", FallbackURL: "https://fallback.example"},
+		types.URLEntry{ShortURL: "b", OriginalURL: srv.URL + "/b"},
+		types.URLEntry{ShortURL: "off", OriginalURL: srv.URL + "/off", Disabled: true},
+	)
+	c := NewChecker(st, Options{Concurrency: 2, FailureThreshold: 2, HistorySize: 3, Client: srv.Client()})
+	defer c.Close()
+	ctx := context.Background()
+
+	require.NoError(t, c.CheckAll(ctx))
+	h, ok := c.Health("a")
+	require.True(t, ok)
+	require.Len(t, h.Results, 1)
+	assert.Equal(t, http.StatusOK, h.Results[0].Status)
+	// HEAD is not allowed, so both links were fetched again with GET
+	assert.ElementsMatch(t, []string{"HEAD", "HEAD", "GET", "GET"}, methods)
+	_, ok = c.Health("off")
+	assert.False(t, ok)
+
+	down.Store(true)
+	require.NoError(t, c.CheckAll(ctx))
+	entry, err := st.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.False(t, entry.FailedOver)
+
+	require.NoError(t, c.CheckAll(ctx))
+	entry, err = st.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.True(t, entry.FailedOver)
+	// links without a fallback only record the failures
+	h, _ = c.Health("b")
+	assert.Equal(t, 2, h.ConsecutiveFailures)
+	assert.Equal(t, http.StatusBadGateway, h.Results[1].Status)
+
+	down.Store(false)
+	require.NoError(t, c.CheckAll(ctx))
+	entry, err = st.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.False(t, entry.FailedOver)
+
+	h, _ = c.Health("a")
+	assert.Len(t, h.Results, 3)
+	assert.Equal(t, 0, h.ConsecutiveFailures)
+}
+
+// editingStorage edits a link right after the checker read it.
+type editingStorage struct {
+	*memory.MemoryStorage
+
+	edit func(entry types.URLEntry) types.URLEntry
+}
+
+func (s *editingStorage) Get(ctx context.Context, shortURL string) (types.URLEntry, error) {
+	entry, err := s.MemoryStorage.Get(ctx, shortURL)
+	if err == nil && s.edit != nil {
+		err = s.MemoryStorage.Update(ctx, s.edit(entry))
+	}
+	return entry, err
+}
+
+func TestFailoverKeepsEdits(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	st := &editingStorage{MemoryStorage: newStorage(t,
+		types.URLEntry{ShortURL: "a", OriginalURL: srv.URL + "/a", FallbackURL: "https://fallback.example"},
+	)}
+	st.edit = func(entry types.URLEntry) types.URLEntry {
+		entry.FallbackURL = "https://fallback.example/new"
+		return entry
+	}
+	c := NewChecker(st, Options{FailureThreshold: 1, Client: srv.Client()})
+	defer c.Close()
+
+	require.NoError(t, c.CheckAll(context.Background()))
+	entry, err := st.MemoryStorage.Get(context.Background(), "a")
+	require.NoError(t, err)
+	assert.True(t, entry.FailedOver)
+	assert.Equal(t, "https://fallback.example/new", entry.FallbackURL)
+}
+
+func TestLimits(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	var entries []types.URLEntry
+	for i := range 6 {
+		code := strconv.Itoa(i)
+		entries = append(entries, types.URLEntry{ShortURL: code, OriginalURL: srv.URL + "/" + code})
+	}
+
+	t.Run("concurrency", func(t *testing.T) {
+		c := NewChecker(newStorage(t, entries...), Options{Concurrency: 2, Client: srv.Client()})
+		require.NoError(t, c.CheckAll(context.Background()))
+		assert.Equal(t, int32(2), maxInFlight.Load())
+	})
+
+	t.Run("per host", func(t *testing.T) {
+		maxInFlight.Store(0)
+		c := NewChecker(newStorage(t, entries[:3]...), Options{
+			Concurrency:  3,
+			HostInterval: 50 * time.Millisecond,
+			Client:       srv.Client(),
+		})
+		start := time.Now()
+		require.NoError(t, c.CheckAll(context.Background()))
+		assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+		assert.Equal(t, int32(1), maxInFlight.Load())
+	})
+}
+
+func TestCheckErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	st := newStorage(t, types.URLEntry{ShortURL: "slow", OriginalURL: srv.URL})
+	c := NewChecker(st, Options{Timeout: 20 * time.Millisecond, Client: srv.Client()})
+	require.NoError(t, c.CheckAll(context.Background()))
+	h, _ := c.Health("slow")
+	require.Len(t, h.Results, 1)
+	assert.False(t, h.Results[0].OK())
+	assert.Contains(t, h.Results[0].Error, "deadline exceeded")
+
+	// the default client does not connect to loopback addresses
+	c = NewChecker(st, Options{})
+	require.NoError(t, c.CheckAll(context.Background()))
+	h, _ = c.Health("slow")
+	require.Len(t, h.Results, 1)
+	assert.Contains(t, h.Results[0].Error, errPrivateAddress.Error())
+}
@@ -0,0 +1,120 @@
+package keyring
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Keyring holds AES-GCM keys by ID and a separate key for URL hashes.
+// New values are always encrypted with the active key; older keys are kept
+// so records written before a rotation can still be decrypted.
+type Keyring struct {
+	active  string
+	ciphers map[string]cipher.AEAD
+	hashKey []byte
+}
+
+// New builds a keyring from "id:base64key" pairs. Keys must be 16, 24 or 32
+// bytes long; hashKey is base64 encoded and at least 32 bytes long.
+func New(keys []string, active string, hashKey string) (*Keyring, error) {
+	kr := &Keyring{active: active, ciphers: make(map[string]cipher.AEAD)}
+
+	for _, pair := range keys {
+		id, encoded, ok := strings.Cut(pair, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("invalid key %q, expected id:base64key", pair)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s: %w", id, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s: %w", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s: %w", id, err)
+		}
+		kr.ciphers[id] = aead
+	}
+
+	if _, ok := kr.ciphers[active]; !ok {
+		return nil, fmt.Errorf("active key %q is not in the keyring", active)
+	}
+
+	var err error
+	kr.hashKey, err = base64.StdEncoding.DecodeString(hashKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hash key: %w", err)
+	}
+	if len(kr.hashKey) < 32 {
+		return nil, errors.New("hash key must be at least 32 bytes")
+	}
+
+	return kr, nil
+}
+
+// ActiveKeyID returns the ID of the key used for new values.
+func (kr *Keyring) ActiveKeyID() string {
+	return kr.active
+}
+
+// Encrypt encrypts plaintext with the active key and returns the key ID
+// and base64 encoded nonce+ciphertext.
+func (kr *Keyring) Encrypt(plaintext string) (string, string, error) {
+	aead := kr.ciphers[kr.active]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	// key id is authenticated so a value cannot be relabelled with another key
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), []byte(kr.active))
+	return kr.active, base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt decrypts a value produced by Encrypt with the given key.
+func (kr *Keyring) Decrypt(keyID, ciphertext string) (string, error) {
+	aead, ok := kr.ciphers[keyID]
+	if !ok {
+		return "", fmt.Errorf("unknown key %q", keyID)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode ciphertext: %w", err)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("ciphertext is too short")
+	}
+	nonce, sealed := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, sealed, []byte(keyID))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt: %w", err)
+	}
+	return string(plaintext), nil
+}
+
+// Hash returns a keyed hash of value, used to find duplicates without
+// storing the plaintext.
+func (kr *Keyring) Hash(value string) string {
+	mac := hmac.New(sha256.New, kr.hashKey)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Code returns a short code for value derived from a keyed hash, so the
+// code reveals nothing about value without the hash key. Codes are 11
+// characters long and never valid standard base64.
+func (kr *Keyring) Code(value string) string {
+	mac := hmac.New(sha256.New, kr.hashKey)
+	mac.Write([]byte("code\x00" + value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:8])
+}
@@ -0,0 +1,268 @@
+package logger
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const redacted = "REDACTED"
+
+// AccessLogFormats are the names accepted in AccessLogOptions.Format.
+var AccessLogFormats = []string{"json", "combined"}
+
+type AccessLogOptions struct {
+	// Format is one of AccessLogFormats, json when empty. The combined
+	// format is the Apache one and is written to Output.
+	Format string
+	// LogBodies adds request and response bodies to json lines, at most
+	// MaxBodySize bytes of each
+	LogBodies   bool
+	MaxBodySize int
+	// RedactParams are query parameters and JSON fields whose values are
+	// replaced in logged URLs and bodies
+	RedactParams []string
+	// RedactCookies are cookies whose values are replaced in json lines,
+	// "*" redacts every cookie
+	RedactCookies []string
+	// SampleRates maps chi route patterns to the share of their requests
+	// that are logged, other routes are always logged. Server errors are
+	// logged regardless.
+	SampleRates map[string]float64
+	// Output receives combined lines, os.Stdout when nil
+	Output io.Writer
+}
+
+// AccessLog logs requests and responses.
+type AccessLog struct {
+	opts AccessLogOptions
+
+	paramsRe *regexp.Regexp
+
+	mu sync.Mutex // serializes writes to opts.Output
+}
+
+func NewAccessLog(opts AccessLogOptions) *AccessLog {
+	if opts.Format == "" {
+		opts.Format = "json"
+	}
+	if opts.Output == nil {
+		opts.Output = os.Stdout
+	}
+	a := &AccessLog{opts: opts}
+	if len(opts.RedactParams) > 0 {
+		names := make([]string, len(opts.RedactParams))
+		for i, name := range opts.RedactParams {
+			names[i] = regexp.QuoteMeta(name)
+		}
+		alt := strings.Join(names, "|")
+		// query parameters in URLs and form bodies, and string fields in
+		// JSON bodies
+		a.paramsRe = regexp.MustCompile(`(?i)((?:^|[?&])(?:` + alt + `)=)[^&#"\s]*|("(?:` + alt + `)"\s*:\s*")(?:[^"\\]|\\.)*"`)
+	}
+	return a
+}
+
+// ParseSampleRate parses a "route=ratio" pair of AccessLogOptions.SampleRates.
+func ParseSampleRate(s string) (string, float64, error) {
+	route, ratio, ok := strings.Cut(s, "=")
+	if !ok {
+		return "", 0, fmt.Errorf("invalid sample rate %q, want route=ratio", s)
+	}
+	rate, err := strconv.ParseFloat(ratio, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid sample rate %q: %w", s, err)
+	}
+	return route, rate, nil
+}
+
+// Middleware logs every sampled request. Routes are known when it runs, so
+// it has to be used inside the router, not wrapped around it.
+func (a *AccessLog) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sampled := a.sampled(r)
+		log := FromContext(r.Context())
+
+		var reqBody []byte
+		if a.opts.LogBodies && sampled && r.Body != nil {
+			reqBody = peekBody(r, a.opts.MaxBodySize)
+		}
+		if sampled && a.opts.Format == "json" {
+			fields := []zap.Field{
+				zap.String("method", r.Method),
+				zap.String("uri", a.redactURL(r.RequestURI)),
+				zap.String("content_type", r.Header.Get("Content-Type")),
+			}
+			if cookies := a.redactCookies(r); cookies != "" {
+				fields = append(fields, zap.String("cookies", cookies))
+			}
+			if a.opts.LogBodies {
+				fields = append(fields, zap.String("body", a.redactText(string(reqBody))))
+			}
+			log.Info("incoming HTTP request", fields...)
+		}
+
+		lw := &loggingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		if a.opts.LogBodies && sampled {
+			lw.body = &bytes.Buffer{}
+			lw.maxBody = a.opts.MaxBodySize
+		}
+		next.ServeHTTP(lw, r)
+
+		if !sampled && lw.status < http.StatusInternalServerError {
+			return
+		}
+		if a.opts.Format == "combined" {
+			a.writeCombined(r, lw, start)
+			return
+		}
+		fields := []zap.Field{
+			zap.Int("status", lw.status),
+			zap.Int("size", lw.size),
+			zap.Duration("duration", time.Since(start)),
+			zap.String("request_URI", a.redactURL(r.URL.String())),
+			zap.String("content_type", w.Header().Get("Content-Type")),
+		}
+		if location := w.Header().Get("Location"); location != "" {
+			fields = append(fields, zap.String("location", a.redactURL(location)))
+		}
+		if lw.body != nil {
+			fields = append(fields, zap.String("response_body", a.redactText(lw.body.String())))
+		}
+		log.Info("outgoing HTTP response", fields...)
+	})
+}
+
+func (a *AccessLog) sampled(r *http.Request) bool {
+	if len(a.opts.SampleRates) == 0 {
+		return true
+	}
+	route := ""
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		route = rctx.RoutePattern()
+	}
+	rate, ok := a.opts.SampleRates[route]
+	return !ok || rand.Float64() < rate
+}
+
+// writeCombined writes an Apache combined log line.
+func (a *AccessLog) writeCombined(r *http.Request, lw *loggingResponseWriter, start time.Time) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	size := "-"
+	if lw.size > 0 {
+		size = fmt.Sprint(lw.size)
+	}
+	line := fmt.Sprintf("%s - - [%s] %q %d %s %q %q\n",
+		host,
+		start.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method+" "+a.redactURL(r.RequestURI)+" "+r.Proto,
+		lw.status,
+		size,
+		cmp.Or(a.redactURL(r.Referer()), "-"),
+		cmp.Or(r.UserAgent(), "-"),
+	)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := io.WriteString(a.opts.Output, line); err != nil {
+		Log.Error("could not write access log", zap.Error(err))
+	}
+}
+
+// redactURL replaces passwords in the user info and redacted query
+// parameters of rawURL, which may be a request URI.
+func (a *AccessLog) redactURL(rawURL string) string {
+	if u, err := url.Parse(rawURL); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+			rawURL = u.String()
+		}
+	}
+	return a.redactText(rawURL)
+}
+
+// redactText replaces redacted query parameters and JSON fields in s.
+func (a *AccessLog) redactText(s string) string {
+	if a.paramsRe == nil || s == "" {
+		return s
+	}
+	return a.paramsRe.ReplaceAllStringFunc(s, func(m string) string {
+		sub := a.paramsRe.FindStringSubmatch(m)
+		if sub[1] != "" {
+			return sub[1] + redacted
+		}
+		return sub[2] + redacted + `"`
+	})
+}
+
+// redactCookies returns the request cookies with redacted values replaced.
+func (a *AccessLog) redactCookies(r *http.Request) string {
+	cookies := r.Cookies()
+	parts := make([]string, len(cookies))
+	all := slices.Contains(a.opts.RedactCookies, "*")
+	for i, c := range cookies {
+		value := c.Value
+		if all || slices.Contains(a.opts.RedactCookies, c.Name) {
+			value = redacted
+		}
+		parts[i] = c.Name + "=" + value
+	}
+	return strings.Join(parts, "; ")
+}
+
+// peekBody returns up to limit bytes of the request body and leaves the
+// body readable from the start.
+func peekBody(r *http.Request, limit int) []byte {
+	buf := make([]byte, limit)
+	n, _ := io.ReadFull(r.Body, buf)
+	buf = buf[:n]
+	r.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(buf), r.Body), Closer: r.Body}
+	return buf
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// loggingResponseWriter records the status and size of a response and, if
+// body is set, up to maxBody bytes of it.
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	size    int
+	body    *bytes.Buffer
+	maxBody int
+}
+
+func (r *loggingResponseWriter) Write(b []byte) (int, error) {
+	if r.body != nil && r.body.Len() < r.maxBody {
+		r.body.Write(b[:min(len(b), r.maxBody-r.body.Len())])
+	}
+	size, err := r.ResponseWriter.Write(b)
+	r.size += size
+	return size, err
+}
+
+func (r *loggingResponseWriter) WriteHeader(statusCode int) {
+	r.ResponseWriter.WriteHeader(statusCode)
+	r.status = statusCode
+}
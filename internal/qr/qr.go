@@ -0,0 +1,147 @@
+package qr
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/skip2/go-qrcode"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+)
+
+// Levels maps error correction level names to the share of the code that
+// may be damaged: L 7%, M 15%, Q 25%, H 30%.
+var Levels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,
+	"M": qrcode.Medium,
+	"Q": qrcode.High,
+	"H": qrcode.Highest,
+}
+
+type Options struct {
+	// Size is the width and height of the image in pixels. PNG images are
+	// never smaller than one pixel per module.
+	Size int
+	// Level is a key of Levels
+	Level string
+	// Margin is the quiet zone around the code in modules
+	Margin     int
+	Foreground color.NRGBA
+	Background color.NRGBA
+}
+
+// ParseColor parses "rrggbb" or "rrggbbaa", with an optional leading "#".
+func ParseColor(s string) (color.NRGBA, error) {
+	b, err := hex.DecodeString(strings.TrimPrefix(s, "#"))
+	if err != nil || len(b) != 3 && len(b) != 4 {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q", s)
+	}
+	c := color.NRGBA{R: b[0], G: b[1], B: b[2], A: 0xff}
+	if len(b) == 4 {
+		c.A = b[3]
+	}
+	return c, nil
+}
+
+// modules returns the dark modules of the code for content, including the
+// margin.
+func modules(content string, opts Options) ([][]bool, error) {
+	level, ok := Levels[opts.Level]
+	if !ok {
+		return nil, fmt.Errorf("invalid error correction level %q", opts.Level)
+	}
+	if opts.Margin < 0 {
+		return nil, errors.New("margin must not be negative")
+	}
+	code, err := qrcode.New(content, level)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode QR code: %w", err)
+	}
+	code.DisableBorder = true
+	bitmap := code.Bitmap()
+
+	n := len(bitmap) + 2*opts.Margin
+	grid := make([][]bool, n)
+	for y := range grid {
+		grid[y] = make([]bool, n)
+	}
+	for y, row := range bitmap {
+		copy(grid[y+opts.Margin][opts.Margin:], row)
+	}
+	return grid, nil
+}
+
+// PNG renders the code as a two-color PNG. Modules are scaled by a whole
+// number of pixels and the code is centered in the image.
+func PNG(content string, opts Options) ([]byte, error) {
+	grid, err := modules(content, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(grid)
+	size := max(opts.Size, n)
+	scale := size / n
+	offset := (size - scale*n) / 2
+
+	img := image.NewPaletted(image.Rect(0, 0, size, size), color.Palette{opts.Background, opts.Foreground})
+	for y, row := range grid {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+			for py := range scale {
+				for px := range scale {
+					img.SetColorIndex(offset+x*scale+px, offset+y*scale+py, 1)
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("failed to encode PNG: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// SVG renders the code as a scalable image, one module per user unit.
+func SVG(content string, opts Options) ([]byte, error) {
+	grid, err := modules(content, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(grid)
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		opts.Size, opts.Size, n, n)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d"%s/>`, n, n, fill(opts.Background))
+	b.WriteString(`<path d="`)
+	for y, row := range grid {
+		// one rectangle per run of dark modules
+		for x := 0; x < n; x++ {
+			if !row[x] {
+				continue
+			}
+			start := x
+			for x < n && row[x] {
+				x++
+			}
+			fmt.Fprintf(&b, "M%d %dh%dv1h-%dz", start, y, x-start, x-start)
+		}
+	}
+	fmt.Fprintf(&b, `"%s/></svg>`, fill(opts.Foreground))
+	return []byte(b.String()), nil
+}
+
+func fill(c color.NRGBA) string {
+	attr := fmt.Sprintf(` fill="#%02x%02x%02x"`, c.R, c.G, c.B)
+	if c.A != 0xff {
+		attr += fmt.Sprintf(` fill-opacity="%.3g"`, float64(c.A)/0xff)
+	}
+	return attr
+}
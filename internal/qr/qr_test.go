@@ -0,0 +1,69 @@
+package qr
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestParseColor(t *testing.T) {
+	c, err := ParseColor("#102030")
+	require.NoError(t, err)
+	assert.Equal(t, color.NRGBA{R: 0x10, G: 0x20, B: 0x30, A: 0xff}, c)
+
+	c, err = ParseColor("10203080")
+	require.NoError(t, err)
+	assert.Equal(t, uint8(0x80), c.A)
+
+	for _, s := range []string{"", "fff", "12345", "zzzzzz", "1020304050"} {
+		_, err := ParseColor(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestRender(t *testing.T) {
+	opts := Options{
+		Size:       100,
+		Level:      "M",
+		Margin:     4,
+		Foreground: color.NRGBA{A: 0xff},
+		Background: color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff},
+	}
+	content := "http://localhost:8080/abc"
+
+	data, err := PNG(content, opts)
+	require.NoError(t, err)
+	img, err := png.Decode(bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, 100, img.Bounds().Dx())
+	// the margin is background, the finder pattern in the corner is not
+	assert.Equal(t, opts.Background, color.NRGBAModel.Convert(img.At(2, 2)))
+	grid, err := modules(content, opts)
+	require.NoError(t, err)
+	scale := 100 / len(grid)
+	offset := (100 - scale*len(grid)) / 2
+	corner := offset + opts.Margin*scale
+	assert.Equal(t, opts.Foreground, color.NRGBAModel.Convert(img.At(corner, corner)))
+
+	// images are never smaller than the code
+	opts.Size = 1
+	data, err = PNG(content, opts)
+	require.NoError(t, err)
+	img, err = png.Decode(bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, len(grid), img.Bounds().Dx())
+
+	opts.Foreground = color.NRGBA{R: 0xff, A: 0x80}
+	svg, err := SVG(content, opts)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(svg), "<svg"))
+	assert.Contains(t, string(svg), `fill="#ff0000" fill-opacity="0.502"`)
+
+	opts.Level = "X"
+	_, err = PNG(content, opts)
+	assert.Error(t, err)
+}
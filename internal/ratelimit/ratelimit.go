@@ -0,0 +1,86 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// FailureLimiter locks a key out after max failures within window. The
+// window starts with the first failure, so a locked key is let through again
+// once it has passed.
+type FailureLimiter struct {
+	max    int
+	window time.Duration
+
+	mu        sync.Mutex
+	failures  map[string]*failures
+	lastPrune time.Time
+}
+
+type failures struct {
+	count int
+	start time.Time
+}
+
+func NewFailureLimiter(max int, window time.Duration) *FailureLimiter {
+	return &FailureLimiter{
+		max:      max,
+		window:   window,
+		failures: make(map[string]*failures),
+	}
+}
+
+// Allow reports whether key may try again and, if not, how long it has to wait.
+func (l *FailureLimiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, ok := l.failures[key]
+	if !ok || f.count < l.max {
+		return true, 0
+	}
+	left := time.Until(f.start.Add(l.window))
+	if left <= 0 {
+		delete(l.failures, key)
+		return true, 0
+	}
+	return false, left
+}
+
+// Fail records a failed attempt.
+func (l *FailureLimiter) Fail(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.prune(now)
+
+	f, ok := l.failures[key]
+	if !ok || now.Sub(f.start) >= l.window {
+		l.failures[key] = &failures{count: 1, start: now}
+		return
+	}
+	f.count++
+}
+
+// Reset forgets the failures of key after a successful attempt.
+func (l *FailureLimiter) Reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.failures, key)
+}
+
+// prune drops expired keys at most once per window so the map does not grow
+// with every client that ever failed.
+func (l *FailureLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < l.window {
+		return
+	}
+	l.lastPrune = now
+	for key, f := range l.failures {
+		if now.Sub(f.start) >= l.window {
+			delete(l.failures, key)
+		}
+	}
+}
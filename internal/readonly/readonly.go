@@ -0,0 +1,62 @@
+package readonly
+
+import (
+	"sync"
+	"time"
+)
+
+// Mode tracks whether the server accepts writes. It is switched on manually
+// for planned maintenance or automatically when storage rejects writes; the
+// automatic switch expires after retryAfter so the next write probes storage again.
+type Mode struct {
+	retryAfter time.Duration
+
+	mu          sync.Mutex
+	maintenance bool
+	until       time.Time
+	reason      string
+}
+
+func NewMode(retryAfter time.Duration) *Mode {
+	return &Mode{retryAfter: retryAfter}
+}
+
+// Active reports whether writes are currently refused, why, and when the
+// client should retry.
+func (m *Mode) Active() (bool, string, time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.maintenance {
+		return true, m.reason, m.retryAfter
+	}
+	if left := time.Until(m.until); left > 0 {
+		return true, m.reason, left
+	}
+	return false, "", 0
+}
+
+// Trip switches to read-only after a failed write.
+func (m *Mode) Trip(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.until = time.Now().Add(m.retryAfter)
+	if !m.maintenance {
+		m.reason = reason
+	}
+}
+
+// SetMaintenance turns planned maintenance on or off. Turning it off also
+// clears an automatic switch.
+func (m *Mode) SetMaintenance(enabled bool, reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.maintenance = enabled
+	m.until = time.Time{}
+	m.reason = ""
+	if enabled {
+		m.reason = reason
+	}
+}
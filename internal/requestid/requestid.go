@@ -0,0 +1,83 @@
+package requestid
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/repriest/url-shortener/internal/logger"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+)
+
+// Header carries the request ID in requests and responses.
+const Header = "X-Request-ID"
+
+const maxLength = 128
+
+type ctxKey struct{}
+
+// FromContext returns the ID of the request ctx belongs to, empty outside
+// of requests.
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(ctxKey{}).(string)
+	return id
+}
+
+// Middleware gives every request an ID, taken from the X-Request-ID header
+// if the client or a proxy sent a valid one. The ID is returned in the
+// response header and added to the request logger, see logger.FromContext.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(Header)
+		if !valid(id) {
+			id = uuid.New().String()
+		}
+		w.Header().Set(Header, id)
+
+		ctx := context.WithValue(r.Context(), ctxKey{}, id)
+		ctx = logger.NewContext(ctx, logger.FromContext(ctx).With(zap.String("request_id", id)))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// valid reports whether id is safe to log and echo back: short and made of
+// letters, digits and a few separators.
+func valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	return strings.Trim(id, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_.:") == ""
+}
+
+// ErrorBodies adds the request ID to plain text error responses, as written
+// by http.Error, so users can quote it. It must run inside any middleware
+// that encodes the body.
+func ErrorBodies(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&errorWriter{ResponseWriter: w, id: FromContext(r.Context())}, r)
+	})
+}
+
+type errorWriter struct {
+	http.ResponseWriter
+	id      string
+	isError bool
+	done    bool
+}
+
+func (e *errorWriter) WriteHeader(statusCode int) {
+	e.isError = statusCode >= http.StatusBadRequest && e.id != "" &&
+		strings.HasPrefix(e.Header().Get("Content-Type"), "text/plain")
+	e.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write appends the ID to the first write of an error, http.Error writes
+// its message at once.
+func (e *errorWriter) Write(b []byte) (int, error) {
+	n, err := e.ResponseWriter.Write(b)
+	if err == nil && e.isError && !e.done {
+		e.done = true
+		_, err = e.ResponseWriter.Write([]byte("Request ID: " + e.id + "\n"))
+	}
+	return n, err
+}
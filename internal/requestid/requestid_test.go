@@ -0,0 +1,72 @@
+package requestid
+
+import (
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	var seen string
+	h := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = FromContext(r.Context())
+	}))
+	do := func(id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if id != "" {
+			req.Header.Set(Header, id)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do("edge-1:abc.42")
+	assert.Equal(t, "edge-1:abc.42", rec.Header().Get(Header))
+	assert.Equal(t, "edge-1:abc.42", seen)
+
+	// missing and invalid IDs are replaced
+	for _, id := range []string{"", "bad id", "x\r\ny", strings.Repeat("a", maxLength+1)} {
+		rec = do(id)
+		got := rec.Header().Get(Header)
+		assert.NotEqual(t, id, got)
+		assert.Equal(t, got, seen)
+		_, err := uuid.Parse(got)
+		assert.NoError(t, err, id)
+	}
+}
+
+func TestErrorBodies(t *testing.T) {
+	do := func(handler http.HandlerFunc) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(Header, "req-1")
+		rec := httptest.NewRecorder()
+		Middleware(ErrorBodies(handler)).ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Not found", http.StatusNotFound)
+	})
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, "Not found\nRequest ID: req-1\n", rec.Body.String())
+
+	// other error bodies and successful responses are left alone
+	rec = do(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(`{"errors":[]}`))
+	})
+	assert.Equal(t, `{"errors":[]}`, rec.Body.String())
+
+	rec = do(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("ok"))
+	})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "ok", rec.Body.String())
+}
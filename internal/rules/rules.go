@@ -0,0 +1,168 @@
+package rules
+
+import (
+	"errors"
+	"fmt"
+	t "github.com/repriest/url-shortener/internal/storage/types"
+	"github.com/repriest/url-shortener/internal/useragent"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxRules = 50
+
+// Input is what rules are matched against.
+type Input struct {
+	UserAgent      string
+	AcceptLanguage string
+	Country        string
+	Now            time.Time
+}
+
+// Evaluate returns the index of the first matching rule, or -1.
+func Evaluate(rules []t.Rule, in Input) int {
+	device := useragent.Device(in.UserAgent)
+	language := PreferredLanguage(in.AcceptLanguage)
+	country := strings.ToUpper(strings.TrimSpace(in.Country))
+	now := in.Now.UTC()
+
+	for i, rule := range rules {
+		if len(rule.Devices) > 0 && !slices.Contains(rule.Devices, device) {
+			continue
+		}
+		if len(rule.Languages) > 0 && !matchLanguage(rule.Languages, language) {
+			continue
+		}
+		if len(rule.Countries) > 0 && !slices.ContainsFunc(rule.Countries, func(c string) bool {
+			return strings.EqualFold(c, country)
+		}) {
+			continue
+		}
+		if rule.NotBefore != nil && now.Before(*rule.NotBefore) {
+			continue
+		}
+		if rule.NotAfter != nil && !now.Before(*rule.NotAfter) {
+			continue
+		}
+		if rule.Hours != "" && !inHours(rule.Hours, now) {
+			continue
+		}
+		return i
+	}
+	return -1
+}
+
+// Validate checks rules before they are stored.
+func Validate(rules []t.Rule) error {
+	if len(rules) > maxRules {
+		return fmt.Errorf("at most %d rules are allowed", maxRules)
+	}
+	for i, rule := range rules {
+		if _, err := url.ParseRequestURI(rule.Destination); err != nil {
+			return fmt.Errorf("rule %d: invalid destination", i)
+		}
+		for _, d := range rule.Devices {
+			switch d {
+			case useragent.DeviceDesktop, useragent.DeviceMobile, useragent.DeviceTablet, useragent.DeviceBot:
+			default:
+				return fmt.Errorf("rule %d: unknown device %q", i, d)
+			}
+		}
+		if rule.NotBefore != nil && rule.NotAfter != nil && !rule.NotBefore.Before(*rule.NotAfter) {
+			return fmt.Errorf("rule %d: not_before must be before not_after", i)
+		}
+		if rule.Hours != "" {
+			if _, _, err := parseHours(rule.Hours); err != nil {
+				return fmt.Errorf("rule %d: %w", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// PreferredLanguage returns the lowercased language tag with the highest
+// quality from an Accept-Language header, or "" if there is none.
+func PreferredLanguage(header string) string {
+	type lang struct {
+		tag string
+		q   float64
+	}
+	var langs []lang
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if q > 0 {
+			langs = append(langs, lang{tag, q})
+		}
+	}
+	if len(langs) == 0 {
+		return ""
+	}
+	// stable sort keeps header order for equal quality
+	sort.SliceStable(langs, func(i, j int) bool { return langs[i].q > langs[j].q })
+	return langs[0].tag
+}
+
+// matchLanguage matches "en" against "en" and "en-us", "en-us" only against "en-us".
+func matchLanguage(ruleLangs []string, language string) bool {
+	if language == "" {
+		return false
+	}
+	for _, l := range ruleLangs {
+		l = strings.ToLower(l)
+		if language == l || strings.HasPrefix(language, l+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+var errInvalidHours = errors.New(`hours must look like "09:00-17:30"`)
+
+func parseHours(hours string) (time.Duration, time.Duration, error) {
+	from, to, ok := strings.Cut(hours, "-")
+	if !ok {
+		return 0, 0, errInvalidHours
+	}
+	start, err := time.Parse("15:04", strings.TrimSpace(from))
+	if err != nil {
+		return 0, 0, errInvalidHours
+	}
+	end, err := time.Parse("15:04", strings.TrimSpace(to))
+	if err != nil {
+		return 0, 0, errInvalidHours
+	}
+	return sinceMidnight(start), sinceMidnight(end), nil
+}
+
+func inHours(hours string, now time.Time) bool {
+	start, end, err := parseHours(hours)
+	if err != nil {
+		return false
+	}
+	current := sinceMidnight(now)
+	if start <= end {
+		return current >= start && current < end
+	}
+	// window wraps past midnight, e.g. 22:00-06:00
+	return current >= start || current < end
+}
+
+func sinceMidnight(tm time.Time) time.Duration {
+	return time.Duration(tm.Hour())*time.Hour + time.Duration(tm.Minute())*time.Minute
+}
@@ -0,0 +1,238 @@
+package breaker
+
+import (
+	"context"
+	"errors"
+	t "github.com/repriest/url-shortener/internal/storage/types"
+	"sync"
+	"time"
+)
+
+type State int
+
+const (
+	StateClosed State = iota
+	StateOpen
+	StateHalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// Breaker wraps a storage backend and stops calling it after threshold
+// consecutive failures. After openTimeout a single probe request is let
+// through; its result either closes the breaker or opens it again.
+type Breaker struct {
+	t.Storage
+
+	threshold   int
+	openTimeout time.Duration
+
+	mu       sync.Mutex
+	state    State
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func NewBreaker(st t.Storage, threshold int, openTimeout time.Duration) *Breaker {
+	return &Breaker{
+		Storage:     st,
+		threshold:   threshold,
+		openTimeout: openTimeout,
+	}
+}
+
+// Unwrap returns the wrapped storage.
+func (b *Breaker) Unwrap() t.Storage {
+	return b.Storage
+}
+
+// State returns the current breaker state.
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == StateOpen && time.Since(b.openedAt) >= b.openTimeout {
+		return StateHalfOpen
+	}
+	return b.state
+}
+
+func (b *Breaker) Load(ctx context.Context) ([]t.URLEntry, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	entries, err := b.Storage.Load(ctx)
+	b.record(ctx, err)
+	return entries, err
+}
+
+func (b *Breaker) Get(ctx context.Context, shortURL string) (t.URLEntry, error) {
+	if err := b.allow(); err != nil {
+		return t.URLEntry{}, err
+	}
+	entry, err := b.Storage.Get(ctx, shortURL)
+	b.record(ctx, err)
+	return entry, err
+}
+
+func (b *Breaker) GetMany(ctx context.Context, shortURLs []string) (map[string]t.URLEntry, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	entries, err := b.Storage.GetMany(ctx, shortURLs)
+	b.record(ctx, err)
+	return entries, err
+}
+
+func (b *Breaker) Append(ctx context.Context, entry t.URLEntry) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := b.Storage.Append(ctx, entry)
+	b.record(ctx, err)
+	return err
+}
+
+func (b *Breaker) BatchAppend(ctx context.Context, entries []t.URLEntry) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := b.Storage.BatchAppend(ctx, entries)
+	b.record(ctx, err)
+	return err
+}
+
+func (b *Breaker) Update(ctx context.Context, entry t.URLEntry) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := b.Storage.Update(ctx, entry)
+	b.record(ctx, err)
+	return err
+}
+
+func (b *Breaker) SetFailedOver(ctx context.Context, shortURL string, failedOver bool) error {
+	fs, ok := t.As[t.FailoverStorage](b.Storage)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := fs.SetFailedOver(ctx, shortURL, failedOver)
+	b.record(ctx, err)
+	return err
+}
+
+func (b *Breaker) FindByURLHash(ctx context.Context, urlHash string) ([]t.URLEntry, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	entries, err := b.Storage.FindByURLHash(ctx, urlHash)
+	b.record(ctx, err)
+	return entries, err
+}
+
+// AddClick is only passed through while the breaker is closed and never
+// counts towards it. Clicks are written to the primary while redirects may
+// be read from replicas, so failing clicks must not stop redirects.
+func (b *Breaker) AddClick(ctx context.Context, shortURL, variant string) error {
+	if b.State() != StateClosed {
+		return t.ErrUnavailable
+	}
+	return b.Storage.AddClick(ctx, shortURL, variant)
+}
+
+func (b *Breaker) Clicks(ctx context.Context, shortURL string) (map[string]int64, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	counts, err := b.Storage.Clicks(ctx, shortURL)
+	b.record(ctx, err)
+	return counts, err
+}
+
+// Ping always reaches the backend so health checks report the real state.
+func (b *Breaker) Ping(ctx context.Context) error {
+	return b.Storage.Ping(ctx)
+}
+
+func (b *Breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case StateOpen:
+		if time.Since(b.openedAt) < b.openTimeout {
+			return t.ErrUnavailable
+		}
+		b.state = StateHalfOpen
+		b.probing = false
+	case StateClosed:
+		return nil
+	}
+
+	// half-open: only one probe at a time
+	if b.probing {
+		return t.ErrUnavailable
+	}
+	b.probing = true
+	return nil
+}
+
+func (b *Breaker) record(ctx context.Context, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	failed := isFailure(ctx, err)
+	switch b.state {
+	case StateHalfOpen:
+		b.probing = false
+		if failed {
+			b.open()
+			return
+		}
+		b.state = StateClosed
+		b.failures = 0
+	case StateClosed:
+		if !failed {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.threshold {
+			b.open()
+		}
+	}
+}
+
+func (b *Breaker) open() {
+	b.state = StateOpen
+	b.openedAt = time.Now()
+	b.failures = 0
+}
+
+// isFailure reports whether err means the backend is unhealthy. Conflicts
+// and missing entries are normal outcomes, and a read-only backend still
+// serves reads, so none of them count. Neither do calls cut short because
+// the client went away or the request timed out.
+func isFailure(ctx context.Context, err error) bool {
+	if err == nil || errors.Is(err, t.ErrReadOnly) || errors.Is(err, t.ErrNotFound) || errors.Is(err, t.ErrShortURLTaken) {
+		return false
+	}
+	if ctx.Err() != nil && (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) {
+		return false
+	}
+	var urlConflictError *t.URLConflictError
+	return !errors.As(err, &urlConflictError)
+}
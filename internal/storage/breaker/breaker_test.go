@@ -0,0 +1,161 @@
+package breaker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/repriest/url-shortener/internal/storage/memory"
+	"github.com/repriest/url-shortener/internal/storage/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubStorage fails Get with err and blocks it while release is set.
+type stubStorage struct {
+	types.Storage
+
+	mu      sync.Mutex
+	err     error
+	calls   int
+	release chan struct{}
+}
+
+func (s *stubStorage) Get(_ context.Context, _ string) (types.URLEntry, error) {
+	s.mu.Lock()
+	s.calls++
+	err, release := s.err, s.release
+	s.mu.Unlock()
+	if release != nil {
+		<-release
+	}
+	return types.URLEntry{}, err
+}
+
+func (s *stubStorage) set(err error, release chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err, s.release = err, release
+}
+
+func newStub(t *testing.T) *stubStorage {
+	mem, err := memory.NewMemoryStorage()
+	require.NoError(t, err)
+	return &stubStorage{Storage: mem}
+}
+
+func TestBreakerStates(t *testing.T) {
+	ctx := context.Background()
+	st := newStub(t)
+	b := NewBreaker(st, 3, 20*time.Millisecond)
+	errDown := errors.New("connection refused")
+
+	// successes reset the failure count
+	st.set(errDown, nil)
+	for i := 0; i < 2; i++ {
+		_, err := b.Get(ctx, "abc")
+		assert.ErrorIs(t, err, errDown)
+	}
+	st.set(nil, nil)
+	_, err := b.Get(ctx, "abc")
+	require.NoError(t, err)
+	assert.Equal(t, StateClosed, b.State())
+
+	// threshold consecutive failures open the breaker
+	st.set(errDown, nil)
+	for i := 0; i < 3; i++ {
+		_, err := b.Get(ctx, "abc")
+		assert.ErrorIs(t, err, errDown)
+	}
+	assert.Equal(t, StateOpen, b.State())
+	calls := st.calls
+	_, err = b.Get(ctx, "abc")
+	assert.ErrorIs(t, err, types.ErrUnavailable)
+	assert.Equal(t, calls, st.calls)
+
+	// a failed probe opens it again
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, StateHalfOpen, b.State())
+	_, err = b.Get(ctx, "abc")
+	assert.ErrorIs(t, err, errDown)
+	assert.Equal(t, StateOpen, b.State())
+
+	// only one probe runs at a time, its success closes the breaker
+	time.Sleep(20 * time.Millisecond)
+	release := make(chan struct{})
+	st.set(nil, release)
+	done := make(chan error)
+	go func() {
+		_, err := b.Get(ctx, "abc")
+		done <- err
+	}()
+	require.Eventually(t, func() bool {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		return st.calls == calls+2
+	}, time.Second, time.Millisecond)
+	_, err = b.Get(ctx, "abc")
+	assert.ErrorIs(t, err, types.ErrUnavailable)
+	close(release)
+	require.NoError(t, <-done)
+	assert.Equal(t, StateClosed, b.State())
+}
+
+func TestBreakerIgnoresExpectedErrors(t *testing.T) {
+	st := newStub(t)
+	b := NewBreaker(st, 1, time.Hour)
+
+	for _, err := range []error{
+		types.ErrNotFound,
+		types.ErrShortURLTaken,
+		&types.URLConflictError{ShortURL: "abc"},
+		fmt.Errorf("%w: disk full", types.ErrReadOnly),
+	} {
+		st.set(err, nil)
+		_, got := b.Get(context.Background(), "abc")
+		assert.ErrorIs(t, got, err)
+		assert.Equal(t, StateClosed, b.State(), err.Error())
+	}
+
+	// calls cut short by the client do not count, timeouts of the backend do
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	st.set(fmt.Errorf("failed to query url: %w", context.Canceled), nil)
+	_, err := b.Get(ctx, "abc")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, StateClosed, b.State())
+
+	st.set(fmt.Errorf("failed to query url: %w", context.DeadlineExceeded), nil)
+	_, err = b.Get(context.Background(), "abc")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, StateOpen, b.State())
+}
+
+func TestIsFailure(t *testing.T) {
+	done, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want bool
+	}{
+		{"nil", context.Background(), nil, false},
+		{"not found", context.Background(), types.ErrNotFound, false},
+		{"conflict", context.Background(), fmt.Errorf("append: %w", &types.URLConflictError{}), false},
+		{"read-only", context.Background(), types.ErrReadOnly, false},
+		{"client canceled", done, context.Canceled, false},
+		{"request timed out", done, context.DeadlineExceeded, false},
+		{"backend timed out", context.Background(), context.DeadlineExceeded, true},
+		{"canceled by backend", context.Background(), context.Canceled, true},
+		{"other error after cancel", done, errors.New("connection reset"), true},
+		{"other error", context.Background(), errors.New("connection reset"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, isFailure(tt.ctx, tt.err))
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package breaker
+
+import (
+	"context"
+	"errors"
+	t "github.com/repriest/url-shortener/internal/storage/types"
+)
+
+// Revisions and reports are passed to the first storage in the chain that
+// keeps them.
+
+func (b *Breaker) Revise(ctx context.Context, entry t.URLEntry, rev t.Revision) (t.Revision, error) {
+	rs, ok := t.As[t.RevisionStorage](b.Storage)
+	if !ok {
+		return t.Revision{}, errors.ErrUnsupported
+	}
+	if err := b.allow(); err != nil {
+		return t.Revision{}, err
+	}
+	rev, err := rs.Revise(ctx, entry, rev)
+	b.record(ctx, err)
+	return rev, err
+}
+
+func (b *Breaker) Revisions(ctx context.Context, shortURL string) ([]t.Revision, error) {
+	rs, ok := t.As[t.RevisionStorage](b.Storage)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	revisions, err := rs.Revisions(ctx, shortURL)
+	b.record(ctx, err)
+	return revisions, err
+}
+
+func (b *Breaker) AddReport(ctx context.Context, report t.Report) error {
+	rs, ok := t.As[t.ReportStorage](b.Storage)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := rs.AddReport(ctx, report)
+	b.record(ctx, err)
+	return err
+}
+
+func (b *Breaker) Reports(ctx context.Context, status string) ([]t.Report, error) {
+	rs, ok := t.As[t.ReportStorage](b.Storage)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	reports, err := rs.Reports(ctx, status)
+	b.record(ctx, err)
+	return reports, err
+}
+
+func (b *Breaker) ResolveReports(ctx context.Context, shortURL, status string) (int, error) {
+	rs, ok := t.As[t.ReportStorage](b.Storage)
+	if !ok {
+		return 0, errors.ErrUnsupported
+	}
+	if err := b.allow(); err != nil {
+		return 0, err
+	}
+	n, err := rs.ResolveReports(ctx, shortURL, status)
+	b.record(ctx, err)
+	return n, err
+}
@@ -0,0 +1,281 @@
+package encrypted
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/repriest/url-shortener/internal/keyring"
+	t "github.com/repriest/url-shortener/internal/storage/types"
+)
+
+// EncryptedStorage encrypts OriginalURL before it reaches the wrapped
+// storage and decrypts it on load. URLHash is set to a keyed hash so the
+// backend can still detect duplicates, and new short codes are keyed hashes
+// too, since the default codes encode the URL.
+type EncryptedStorage struct {
+	t.Storage
+	kr *keyring.Keyring
+}
+
+func NewEncryptedStorage(st t.Storage, kr *keyring.Keyring) *EncryptedStorage {
+	return &EncryptedStorage{Storage: st, kr: kr}
+}
+
+// Unwrap returns the wrapped storage.
+func (s *EncryptedStorage) Unwrap() t.Storage {
+	return s.Storage
+}
+
+func (s *EncryptedStorage) Load(ctx context.Context) ([]t.URLEntry, error) {
+	entries, err := s.Storage.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		if entries[i], err = s.decrypt(entries[i]); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+func (s *EncryptedStorage) Get(ctx context.Context, shortURL string) (t.URLEntry, error) {
+	entry, err := s.Storage.Get(ctx, shortURL)
+	if err != nil {
+		return t.URLEntry{}, err
+	}
+	return s.decrypt(entry)
+}
+
+func (s *EncryptedStorage) GetMany(ctx context.Context, shortURLs []string) (map[string]t.URLEntry, error) {
+	entries, err := s.Storage.GetMany(ctx, shortURLs)
+	if err != nil {
+		return nil, err
+	}
+	for shortURL, entry := range entries {
+		if entries[shortURL], err = s.decrypt(entry); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+func (s *EncryptedStorage) Append(ctx context.Context, entry t.URLEntry) error {
+	entry, err := s.encrypt(entry)
+	if err != nil {
+		return err
+	}
+	return s.Storage.Append(ctx, entry)
+}
+
+func (s *EncryptedStorage) BatchAppend(ctx context.Context, entries []t.URLEntry) error {
+	encrypted := make([]t.URLEntry, len(entries))
+	for i, entry := range entries {
+		var err error
+		if encrypted[i], err = s.encrypt(entry); err != nil {
+			return err
+		}
+	}
+	return s.Storage.BatchAppend(ctx, encrypted)
+}
+
+func (s *EncryptedStorage) Update(ctx context.Context, entry t.URLEntry) error {
+	entry, err := s.encrypt(entry)
+	if err != nil {
+		return err
+	}
+	return s.Storage.Update(ctx, entry)
+}
+
+func (s *EncryptedStorage) FindByURLHash(ctx context.Context, urlHash string) ([]t.URLEntry, error) {
+	entries, err := s.Storage.FindByURLHash(ctx, urlHash)
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		if entries[i], err = s.decrypt(entries[i]); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// HashURL returns the keyed hash entries are stored with, see t.URLHasher.
+func (s *EncryptedStorage) HashURL(originalURL string) string {
+	return s.kr.Hash(originalURL)
+}
+
+// ShortCode returns the code of a new link to originalURL, see t.ShortCoder.
+// It is a keyed hash, so equal URLs still get equal codes.
+func (s *EncryptedStorage) ShortCode(originalURL string) string {
+	return s.kr.Code(originalURL)
+}
+
+// MigrateHashes gives entries written before encryption was enabled the
+// keyed URLHash, so new links to their URLs are detected as duplicates. The
+// entries stay in plaintext until Rotate. It returns how many entries were
+// rewritten; entries whose URL was already shortened again since are
+// skipped.
+func (s *EncryptedStorage) MigrateHashes(ctx context.Context) (int, error) {
+	entries, err := s.Storage.Load(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, entry := range entries {
+		if entry.KeyID != "" || entry.PasswordHash != "" || entry.URLHash == s.kr.Hash(entry.OriginalURL) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return migrated, err
+		}
+		entry.URLHash = s.kr.Hash(entry.OriginalURL)
+		err := s.Storage.Update(ctx, entry)
+		var urlConflictError *t.URLConflictError
+		if errors.As(err, &urlConflictError) {
+			continue
+		}
+		if err != nil {
+			return migrated, fmt.Errorf("failed to migrate hash of %s: %w", entry.ShortURL, err)
+		}
+		migrated++
+	}
+	return migrated, nil
+}
+
+// Rotate re-encrypts every entry that is stored in plaintext or with a key
+// other than the active one and returns how many entries were rewritten.
+// It runs against live storage, entries written meanwhile already use the
+// active key.
+func (s *EncryptedStorage) Rotate(ctx context.Context) (int, error) {
+	entries, err := s.Storage.Load(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	rotated := 0
+	for _, entry := range entries {
+		if entry.KeyID == s.kr.ActiveKeyID() {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return rotated, err
+		}
+		if entry, err = s.decrypt(entry); err != nil {
+			return rotated, err
+		}
+		if err := s.Update(ctx, entry); err != nil {
+			return rotated, fmt.Errorf("failed to rotate %s: %w", entry.ShortURL, err)
+		}
+		rotated++
+	}
+	return rotated, nil
+}
+
+func (s *EncryptedStorage) encrypt(entry t.URLEntry) (t.URLEntry, error) {
+	keyID, ciphertext, err := s.kr.Encrypt(entry.OriginalURL)
+	if err != nil {
+		return t.URLEntry{}, err
+	}
+	entry.URLHash = s.kr.Hash(entry.OriginalURL)
+	entry.KeyID = keyID
+	entry.OriginalURL = ciphertext
+
+	// destinations are copied so the caller's entry is left untouched
+	dests := make([]t.Destination, len(entry.Destinations))
+	for i, d := range entry.Destinations {
+		if _, d.URL, err = s.kr.Encrypt(d.URL); err != nil {
+			return t.URLEntry{}, err
+		}
+		dests[i] = d
+	}
+	entry.Destinations = dests
+
+	rules := make([]t.Rule, len(entry.Rules))
+	for i, rule := range entry.Rules {
+		if _, rule.Destination, err = s.kr.Encrypt(rule.Destination); err != nil {
+			return t.URLEntry{}, err
+		}
+		rules[i] = rule
+	}
+	entry.Rules = rules
+
+	if entry.FallbackURL != "" {
+		if _, entry.FallbackURL, err = s.kr.Encrypt(entry.FallbackURL); err != nil {
+			return t.URLEntry{}, err
+		}
+	}
+
+	if entry.AppLink != nil {
+		link := *entry.AppLink
+		for _, u := range appLinkURLs(&link) {
+			if *u == "" {
+				continue
+			}
+			if _, *u, err = s.kr.Encrypt(*u); err != nil {
+				return t.URLEntry{}, err
+			}
+		}
+		entry.AppLink = &link
+	}
+	return entry, nil
+}
+
+// decrypt returns entry with plaintext OriginalURL. Entries written before
+// encryption was enabled have no key ID and are returned as is.
+func (s *EncryptedStorage) decrypt(entry t.URLEntry) (t.URLEntry, error) {
+	if entry.KeyID == "" {
+		return entry, nil
+	}
+	plaintext, err := s.kr.Decrypt(entry.KeyID, entry.OriginalURL)
+	if err != nil {
+		return t.URLEntry{}, fmt.Errorf("failed to decrypt %s: %w", entry.ShortURL, err)
+	}
+	entry.OriginalURL = plaintext
+
+	dests := make([]t.Destination, len(entry.Destinations))
+	for i, d := range entry.Destinations {
+		if d.URL, err = s.kr.Decrypt(entry.KeyID, d.URL); err != nil {
+			return t.URLEntry{}, fmt.Errorf("failed to decrypt %s destination %s: %w", entry.ShortURL, d.ID, err)
+		}
+		dests[i] = d
+	}
+	entry.Destinations = dests
+
+	rules := make([]t.Rule, len(entry.Rules))
+	for i, rule := range entry.Rules {
+		if rule.Destination, err = s.kr.Decrypt(entry.KeyID, rule.Destination); err != nil {
+			return t.URLEntry{}, fmt.Errorf("failed to decrypt %s rule %d: %w", entry.ShortURL, i, err)
+		}
+		rules[i] = rule
+	}
+	entry.Rules = rules
+
+	if entry.FallbackURL != "" {
+		if entry.FallbackURL, err = s.kr.Decrypt(entry.KeyID, entry.FallbackURL); err != nil {
+			return t.URLEntry{}, fmt.Errorf("failed to decrypt %s fallback: %w", entry.ShortURL, err)
+		}
+	}
+
+	if entry.AppLink != nil {
+		link := *entry.AppLink
+		for _, u := range appLinkURLs(&link) {
+			if *u == "" {
+				continue
+			}
+			if *u, err = s.kr.Decrypt(entry.KeyID, *u); err != nil {
+				return t.URLEntry{}, fmt.Errorf("failed to decrypt %s app link: %w", entry.ShortURL, err)
+			}
+		}
+		entry.AppLink = &link
+	}
+
+	entry.KeyID = ""
+	entry.URLHash = ""
+	return entry, nil
+}
+
+func appLinkURLs(link *t.AppLink) []*string {
+	return []*string{&link.IOSURL, &link.IOSStoreURL, &link.AndroidURL, &link.AndroidStoreURL}
+}
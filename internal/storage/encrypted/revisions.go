@@ -0,0 +1,61 @@
+package encrypted
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	t "github.com/repriest/url-shortener/internal/storage/types"
+)
+
+// Revise encrypts the URLs of the revision with the active key. Revisions
+// are not rewritten by Rotate, so keys stay in the keyring while history
+// written with them is needed.
+func (s *EncryptedStorage) Revise(ctx context.Context, entry t.URLEntry, rev t.Revision) (t.Revision, error) {
+	rs, ok := t.As[t.RevisionStorage](s.Storage)
+	if !ok {
+		return t.Revision{}, errors.ErrUnsupported
+	}
+
+	plain := rev
+	entry, err := s.encrypt(entry)
+	if err != nil {
+		return t.Revision{}, err
+	}
+	for _, u := range []*string{&rev.Old.OriginalURL, &rev.New.OriginalURL} {
+		if rev.KeyID, *u, err = s.kr.Encrypt(*u); err != nil {
+			return t.Revision{}, err
+		}
+	}
+
+	rev, err = rs.Revise(ctx, entry, rev)
+	if err != nil {
+		return t.Revision{}, err
+	}
+	plain.ShortURL, plain.Version = rev.ShortURL, rev.Version
+	return plain, nil
+}
+
+func (s *EncryptedStorage) Revisions(ctx context.Context, shortURL string) ([]t.Revision, error) {
+	rs, ok := t.As[t.RevisionStorage](s.Storage)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+
+	revisions, err := rs.Revisions(ctx, shortURL)
+	if err != nil {
+		return nil, err
+	}
+	for i := range revisions {
+		rev := &revisions[i]
+		if rev.KeyID == "" {
+			continue
+		}
+		for _, u := range []*string{&rev.Old.OriginalURL, &rev.New.OriginalURL} {
+			if *u, err = s.kr.Decrypt(rev.KeyID, *u); err != nil {
+				return nil, fmt.Errorf("failed to decrypt %s revision %d: %w", shortURL, rev.Version, err)
+			}
+		}
+		rev.KeyID = ""
+	}
+	return revisions, nil
+}
@@ -0,0 +1,69 @@
+package file
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"strings"
+)
+
+// clicksPath is where visits are logged next to the entries file, one
+// short URL per line, followed by a space and the variant if there was one.
+func clicksPath(filePath string) string {
+	return filePath + ".clicks"
+}
+
+func loadClicks(path string) (map[string]map[string]int64, error) {
+	clicks := make(map[string]map[string]int64)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return clicks, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open clicks: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) > 0 {
+			shortURL, variant, _ := strings.Cut(scanner.Text(), " ")
+			countClick(clicks, shortURL, variant)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read clicks: %w", err)
+	}
+	return clicks, nil
+}
+
+func countClick(clicks map[string]map[string]int64, shortURL, variant string) {
+	if clicks[shortURL] == nil {
+		clicks[shortURL] = make(map[string]int64)
+	}
+	clicks[shortURL][variant]++
+}
+
+func (s *FileStorage) AddClick(_ context.Context, shortURL, variant string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	line := shortURL
+	if variant != "" {
+		line += " " + variant
+	}
+	if _, err := s.clicksFile.WriteString(line + "\n"); err != nil {
+		return writeError(s.clicksFile.Name(), err)
+	}
+	countClick(s.clicks, shortURL, variant)
+	return nil
+}
+
+func (s *FileStorage) Clicks(_ context.Context, shortURL string) (map[string]int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return maps.Clone(s.clicks[shortURL]), nil
+}
@@ -3,14 +3,31 @@ package file
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	t "github.com/repriest/url-shortener/internal/storage/types"
 	"os"
+	"slices"
 	"strings"
+	"sync"
+	"syscall"
 )
 
+// FileStorage keeps entries as JSON lines in an append-only file. An update
+// appends a new line for the same short URL, the last line wins on load.
 type FileStorage struct {
-	file *os.File
+	mu    sync.RWMutex
+	file  *os.File
+	index map[string]t.URLEntry
+
+	reportsFile *os.File
+	reports     []t.Report
+
+	revisionsFile *os.File
+	revisions     map[string][]t.Revision
+
+	clicksFile *os.File
+	clicks     map[string]map[string]int64
 }
 
 func NewFileStorage(filePath string) (*FileStorage, error) {
@@ -19,10 +36,54 @@ func NewFileStorage(filePath string) (*FileStorage, error) {
 		return nil, fmt.Errorf("failed to open or create file: %w", err)
 	}
 
-	return &FileStorage{file: file}, nil
+	s := &FileStorage{file: file, index: make(map[string]t.URLEntry)}
+	entries, err := s.Load(context.Background())
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to load file: %w", err)
+	}
+	for _, entry := range entries {
+		s.index[entry.ShortURL] = entry
+	}
+
+	if err := s.openSideFiles(filePath); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// openSideFiles loads the reports, revisions and clicks kept next to the
+// entries file and opens them for appending.
+func (s *FileStorage) openSideFiles(filePath string) error {
+	var err error
+	if s.reports, err = loadReports(reportsPath(filePath)); err != nil {
+		return err
+	}
+	if s.reportsFile, err = openAppend(reportsPath(filePath)); err != nil {
+		return fmt.Errorf("failed to open or create reports file: %w", err)
+	}
+	if s.revisions, err = loadRevisions(revisionsPath(filePath)); err != nil {
+		return err
+	}
+	if s.revisionsFile, err = openAppend(revisionsPath(filePath)); err != nil {
+		return fmt.Errorf("failed to open or create revisions file: %w", err)
+	}
+	if s.clicks, err = loadClicks(clicksPath(filePath)); err != nil {
+		return err
+	}
+	if s.clicksFile, err = openAppend(clicksPath(filePath)); err != nil {
+		return fmt.Errorf("failed to open or create clicks file: %w", err)
+	}
+	return nil
+}
+
+func openAppend(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
 }
 
-func (s *FileStorage) Load() ([]t.URLEntry, error) {
+func (s *FileStorage) Load(_ context.Context) ([]t.URLEntry, error) {
 	data, err := os.ReadFile(s.file.Name())
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -32,6 +93,7 @@ func (s *FileStorage) Load() ([]t.URLEntry, error) {
 	}
 	// parse file to []URLentry
 	var entries []t.URLEntry
+	positions := make(map[string]int)
 	lines := strings.Split(string(data), "\n")
 	for _, line := range lines {
 		line = strings.TrimSpace(line)
@@ -43,27 +105,153 @@ func (s *FileStorage) Load() ([]t.URLEntry, error) {
 		if err != nil {
 			return []t.URLEntry{}, err
 		}
+		// later lines are updates of earlier ones
+		if i, ok := positions[entry.ShortURL]; ok {
+			entries[i] = entry
+			continue
+		}
+		positions[entry.ShortURL] = len(entries)
 		entries = append(entries, entry)
 	}
 	return entries, nil
 }
 
-func (s *FileStorage) Append(entry t.URLEntry) error {
-	data, err := json.Marshal(entry)
-	if err != nil {
-		return fmt.Errorf("failed to marshal entry: %w", err)
+func (s *FileStorage) Get(_ context.Context, shortURL string) (t.URLEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, ok := s.index[shortURL]
+	if !ok {
+		return t.URLEntry{}, t.ErrNotFound
 	}
-	data = append(data, '\n')
+	return entry, nil
+}
 
-	_, err = s.file.Write(data)
-	if err != nil {
-		return fmt.Errorf("failed to write to file %s: %w", s.file.Name(), err)
+func (s *FileStorage) GetMany(_ context.Context, shortURLs []string) (map[string]t.URLEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	found := make(map[string]t.URLEntry)
+	for _, shortURL := range shortURLs {
+		if entry, ok := s.index[shortURL]; ok {
+			found[shortURL] = entry
+		}
+	}
+	return found, nil
+}
+
+func (s *FileStorage) Append(_ context.Context, entry t.URLEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if shortURL, ok := s.findHash(t.EntryHash(entry)); ok {
+		return &t.URLConflictError{ShortURL: shortURL}
+	}
+	if err := s.checkNew([]t.URLEntry{entry}); err != nil {
+		return err
+	}
+	return s.write([]t.URLEntry{entry})
+}
+
+// BatchAppend skips entries whose URL is already shortened, as postgres does.
+func (s *FileStorage) BatchAppend(_ context.Context, entries []t.URLEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkNew(entries); err != nil {
+		return err
+	}
+	var added []t.URLEntry
+	hashes := make(map[string]bool)
+	for _, entry := range entries {
+		hash := t.EntryHash(entry)
+		if _, ok := s.findHash(hash); ok || hashes[hash] {
+			continue
+		}
+		hashes[hash] = true
+		added = append(added, entry)
 	}
+	return s.write(added)
+}
 
+// checkNew returns t.ErrShortURLTaken if the short URL of a new entry is
+// used by a link to another URL. Lines for a known short URL would replace
+// its entry on load. Callers hold s.mu.
+func (s *FileStorage) checkNew(entries []t.URLEntry) error {
+	for _, entry := range entries {
+		if existing, ok := s.index[entry.ShortURL]; ok && t.EntryHash(existing) != t.EntryHash(entry) {
+			return t.ErrShortURLTaken
+		}
+	}
 	return nil
 }
 
-func (s *FileStorage) BatchAppend(entries []t.URLEntry) error {
+// findHash returns the short URL of the entry with urlHash. Callers hold s.mu.
+func (s *FileStorage) findHash(urlHash string) (string, bool) {
+	for _, entry := range s.index {
+		if t.EntryHash(entry) == urlHash {
+			return entry.ShortURL, true
+		}
+	}
+	return "", false
+}
+
+func (s *FileStorage) Update(_ context.Context, entry t.URLEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.index[entry.ShortURL]; !ok {
+		return t.ErrNotFound
+	}
+	return s.write([]t.URLEntry{entry})
+}
+
+func (s *FileStorage) SetFailedOver(_ context.Context, shortURL string, failedOver bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.index[shortURL]
+	if !ok {
+		return t.ErrNotFound
+	}
+	entry.FailedOver = failedOver
+	return s.write([]t.URLEntry{entry})
+}
+
+func (s *FileStorage) FindByURLHash(_ context.Context, urlHash string) ([]t.URLEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	found := []t.URLEntry{}
+	for _, entry := range s.index {
+		if t.EntryHash(entry) == urlHash {
+			found = append(found, entry)
+		}
+	}
+	slices.SortFunc(found, func(a, b t.URLEntry) int {
+		return strings.Compare(a.ShortURL, b.ShortURL)
+	})
+	return found, nil
+}
+
+func (s *FileStorage) Close() error {
+	return errors.Join(closeFile(s.file), closeFile(s.reportsFile), closeFile(s.revisionsFile), closeFile(s.clicksFile))
+}
+
+// closeFile closes f unless it was never opened.
+func closeFile(f *os.File) error {
+	if f == nil {
+		return nil
+	}
+	return f.Close()
+}
+
+func (s *FileStorage) Ping(_ context.Context) error {
+	return nil
+}
+
+// write appends entries to the file and the index. Callers hold s.mu.
+func (s *FileStorage) write(entries []t.URLEntry) error {
 	var data []byte
 
 	for _, entry := range entries {
@@ -77,16 +265,20 @@ func (s *FileStorage) BatchAppend(entries []t.URLEntry) error {
 
 	_, err := s.file.Write(data)
 	if err != nil {
-		return fmt.Errorf("failed to write to file %s: %w", s.file.Name(), err)
+		return writeError(s.file.Name(), err)
 	}
 
-	return nil
-}
+	for _, entry := range entries {
+		s.index[entry.ShortURL] = entry
+	}
 
-func (s *FileStorage) Close() error {
-	return s.file.Close()
+	return nil
 }
 
-func (s *FileStorage) Ping(_ context.Context) error {
-	return nil
+// writeError wraps a failed write, marking a full or read-only filesystem with t.ErrReadOnly.
+func writeError(name string, err error) error {
+	if errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EROFS) {
+		return fmt.Errorf("%w: failed to write to file %s: %w", t.ErrReadOnly, name, err)
+	}
+	return fmt.Errorf("failed to write to file %s: %w", name, err)
 }
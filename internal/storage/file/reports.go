@@ -0,0 +1,117 @@
+package file
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	t "github.com/repriest/url-shortener/internal/storage/types"
+	"os"
+)
+
+// reportsPath is where reports are kept next to the entries file. Like
+// entries, a changed report is appended again and the last line wins.
+func reportsPath(filePath string) string {
+	return filePath + ".reports"
+}
+
+func loadReports(path string) ([]t.Report, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open reports: %w", err)
+	}
+	defer f.Close()
+
+	var reports []t.Report
+	positions := make(map[string]int)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var report t.Report
+		if err := json.Unmarshal(scanner.Bytes(), &report); err != nil {
+			return nil, fmt.Errorf("failed to parse report: %w", err)
+		}
+		if i, ok := positions[report.ID]; ok {
+			reports[i] = report
+			continue
+		}
+		positions[report.ID] = len(reports)
+		reports = append(reports, report)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read reports: %w", err)
+	}
+	return reports, nil
+}
+
+func (s *FileStorage) AddReport(_ context.Context, report t.Report) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.writeReports([]t.Report{report}); err != nil {
+		return err
+	}
+	s.reports = append(s.reports, report)
+	return nil
+}
+
+func (s *FileStorage) Reports(_ context.Context, status string) ([]t.Report, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	reports := []t.Report{}
+	for _, r := range s.reports {
+		if status == "" || r.Status == status {
+			reports = append(reports, r)
+		}
+	}
+	return reports, nil
+}
+
+func (s *FileStorage) ResolveReports(_ context.Context, shortURL, status string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var changed []int
+	var resolved []t.Report
+	for i, r := range s.reports {
+		if r.ShortURL == shortURL && r.Status == t.ReportOpen {
+			r.Status = status
+			changed = append(changed, i)
+			resolved = append(resolved, r)
+		}
+	}
+	if len(resolved) == 0 {
+		return 0, nil
+	}
+	if err := s.writeReports(resolved); err != nil {
+		return 0, err
+	}
+	for _, i := range changed {
+		s.reports[i].Status = status
+	}
+	return len(resolved), nil
+}
+
+// writeReports appends reports to the reports file. Callers hold s.mu.
+func (s *FileStorage) writeReports(reports []t.Report) error {
+	var data []byte
+	for _, report := range reports {
+		reportJSON, err := json.Marshal(report)
+		if err != nil {
+			return fmt.Errorf("failed to marshal report: %w", err)
+		}
+		data = append(data, reportJSON...)
+		data = append(data, '\n')
+	}
+
+	if _, err := s.reportsFile.Write(data); err != nil {
+		return writeError(s.reportsFile.Name(), err)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package file
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	t "github.com/repriest/url-shortener/internal/storage/types"
+	"os"
+)
+
+// revisionsPath is where link edits are recorded next to the entries file,
+// one event per line.
+func revisionsPath(filePath string) string {
+	return filePath + ".revisions"
+}
+
+func loadRevisions(path string) (map[string][]t.Revision, error) {
+	revisions := make(map[string][]t.Revision)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return revisions, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open revisions: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rev t.Revision
+		if err := json.Unmarshal(scanner.Bytes(), &rev); err != nil {
+			return nil, fmt.Errorf("failed to parse revision: %w", err)
+		}
+		revisions[rev.ShortURL] = append(revisions[rev.ShortURL], rev)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read revisions: %w", err)
+	}
+	return revisions, nil
+}
+
+// Revise appends the updated entry and then the revision event, a failed
+// revision write leaves the edit without history rather than the other way
+// around.
+func (s *FileStorage) Revise(_ context.Context, entry t.URLEntry, rev t.Revision) (t.Revision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.index[entry.ShortURL]; !ok {
+		return t.Revision{}, t.ErrNotFound
+	}
+	if err := s.write([]t.URLEntry{entry}); err != nil {
+		return t.Revision{}, err
+	}
+
+	rev.ShortURL = entry.ShortURL
+	rev.Version = len(s.revisions[entry.ShortURL]) + 1
+	revJSON, err := json.Marshal(rev)
+	if err != nil {
+		return t.Revision{}, fmt.Errorf("failed to marshal revision: %w", err)
+	}
+	if _, err := s.revisionsFile.Write(append(revJSON, '\n')); err != nil {
+		return t.Revision{}, writeError(s.revisionsFile.Name(), err)
+	}
+	s.revisions[entry.ShortURL] = append(s.revisions[entry.ShortURL], rev)
+	return rev, nil
+}
+
+func (s *FileStorage) Revisions(_ context.Context, shortURL string) ([]t.Revision, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]t.Revision{}, s.revisions[shortURL]...), nil
+}
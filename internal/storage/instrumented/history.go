@@ -0,0 +1,65 @@
+package instrumented
+
+import (
+	"context"
+	"errors"
+	t "github.com/repriest/url-shortener/internal/storage/types"
+)
+
+// Revisions and reports are passed to the first storage in the chain that
+// keeps them.
+
+func (s *Instrumented) Revise(ctx context.Context, entry t.URLEntry, rev t.Revision) (t.Revision, error) {
+	rs, ok := t.As[t.RevisionStorage](s.Storage)
+	if !ok {
+		return t.Revision{}, errors.ErrUnsupported
+	}
+	ctx, op := s.start(ctx, "revise")
+	rev, err := rs.Revise(ctx, entry, rev)
+	op.end(err)
+	return rev, err
+}
+
+func (s *Instrumented) Revisions(ctx context.Context, shortURL string) ([]t.Revision, error) {
+	rs, ok := t.As[t.RevisionStorage](s.Storage)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	ctx, op := s.start(ctx, "revisions")
+	revisions, err := rs.Revisions(ctx, shortURL)
+	op.end(err)
+	return revisions, err
+}
+
+func (s *Instrumented) AddReport(ctx context.Context, report t.Report) error {
+	rs, ok := t.As[t.ReportStorage](s.Storage)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	ctx, op := s.start(ctx, "add_report")
+	err := rs.AddReport(ctx, report)
+	op.end(err)
+	return err
+}
+
+func (s *Instrumented) Reports(ctx context.Context, status string) ([]t.Report, error) {
+	rs, ok := t.As[t.ReportStorage](s.Storage)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	ctx, op := s.start(ctx, "reports")
+	reports, err := rs.Reports(ctx, status)
+	op.end(err)
+	return reports, err
+}
+
+func (s *Instrumented) ResolveReports(ctx context.Context, shortURL, status string) (int, error) {
+	rs, ok := t.As[t.ReportStorage](s.Storage)
+	if !ok {
+		return 0, errors.ErrUnsupported
+	}
+	ctx, op := s.start(ctx, "resolve_reports")
+	n, err := rs.ResolveReports(ctx, shortURL, status)
+	op.end(err)
+	return n, err
+}
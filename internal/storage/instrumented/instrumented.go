@@ -0,0 +1,156 @@
+package instrumented
+
+import (
+	"context"
+	"errors"
+	"github.com/repriest/url-shortener/internal/logger"
+	"github.com/repriest/url-shortener/internal/metrics"
+	t "github.com/repriest/url-shortener/internal/storage/types"
+	"github.com/repriest/url-shortener/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"time"
+)
+
+var tracer = tracing.Tracer("storage")
+
+// Instrumented wraps a storage backend and records the latency, errors and
+// batch sizes of its operations, labeled with the backend name, and a span
+// for each of them.
+type Instrumented struct {
+	t.Storage
+
+	backend string
+}
+
+func NewInstrumented(st t.Storage, backend string) *Instrumented {
+	return &Instrumented{Storage: st, backend: backend}
+}
+
+// Unwrap returns the wrapped storage.
+func (s *Instrumented) Unwrap() t.Storage {
+	return s.Storage
+}
+
+func (s *Instrumented) Load(ctx context.Context) ([]t.URLEntry, error) {
+	ctx, op := s.start(ctx, "load")
+	entries, err := s.Storage.Load(ctx)
+	op.end(err)
+	return entries, err
+}
+
+func (s *Instrumented) Get(ctx context.Context, shortURL string) (t.URLEntry, error) {
+	ctx, op := s.start(ctx, "get")
+	entry, err := s.Storage.Get(ctx, shortURL)
+	op.end(err)
+	return entry, err
+}
+
+func (s *Instrumented) GetMany(ctx context.Context, shortURLs []string) (map[string]t.URLEntry, error) {
+	ctx, op := s.start(ctx, "get_many")
+	metrics.BatchSize.WithLabelValues(s.backend, "get_many").Observe(float64(len(shortURLs)))
+	entries, err := s.Storage.GetMany(ctx, shortURLs)
+	op.end(err)
+	return entries, err
+}
+
+func (s *Instrumented) Append(ctx context.Context, entry t.URLEntry) error {
+	ctx, op := s.start(ctx, "append")
+	err := s.Storage.Append(ctx, entry)
+	op.end(err)
+	return err
+}
+
+func (s *Instrumented) BatchAppend(ctx context.Context, entries []t.URLEntry) error {
+	ctx, op := s.start(ctx, "batch_append")
+	metrics.BatchSize.WithLabelValues(s.backend, "batch_append").Observe(float64(len(entries)))
+	err := s.Storage.BatchAppend(ctx, entries)
+	op.end(err)
+	return err
+}
+
+func (s *Instrumented) Update(ctx context.Context, entry t.URLEntry) error {
+	ctx, op := s.start(ctx, "update")
+	err := s.Storage.Update(ctx, entry)
+	op.end(err)
+	return err
+}
+
+func (s *Instrumented) SetFailedOver(ctx context.Context, shortURL string, failedOver bool) error {
+	fs, ok := t.As[t.FailoverStorage](s.Storage)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	ctx, op := s.start(ctx, "set_failed_over")
+	err := fs.SetFailedOver(ctx, shortURL, failedOver)
+	op.end(err)
+	return err
+}
+
+func (s *Instrumented) FindByURLHash(ctx context.Context, urlHash string) ([]t.URLEntry, error) {
+	ctx, op := s.start(ctx, "find_by_url_hash")
+	entries, err := s.Storage.FindByURLHash(ctx, urlHash)
+	op.end(err)
+	return entries, err
+}
+
+func (s *Instrumented) AddClick(ctx context.Context, shortURL, variant string) error {
+	ctx, op := s.start(ctx, "add_click")
+	err := s.Storage.AddClick(ctx, shortURL, variant)
+	op.end(err)
+	return err
+}
+
+func (s *Instrumented) Clicks(ctx context.Context, shortURL string) (map[string]int64, error) {
+	ctx, op := s.start(ctx, "clicks")
+	counts, err := s.Storage.Clicks(ctx, shortURL)
+	op.end(err)
+	return counts, err
+}
+
+func (s *Instrumented) Ping(ctx context.Context) error {
+	ctx, op := s.start(ctx, "ping")
+	err := s.Storage.Ping(ctx)
+	op.end(err)
+	return err
+}
+
+// operation is a storage call in progress.
+type operation struct {
+	s     *Instrumented
+	ctx   context.Context
+	name  string
+	start time.Time
+	span  trace.Span
+}
+
+func (s *Instrumented) start(ctx context.Context, name string) (context.Context, operation) {
+	ctx, span := tracer.Start(ctx, "storage."+name,
+		trace.WithAttributes(attribute.String("storage.backend", s.backend)))
+	return ctx, operation{s: s, ctx: ctx, name: name, start: time.Now(), span: span}
+}
+
+// end records the latency of the operation and err, unless it is a normal
+// outcome: a missing entry or a conflict with an existing one. Errors are
+// logged with the logger of the request that caused them.
+func (op operation) end(err error) {
+	metrics.StorageDuration.WithLabelValues(op.s.backend, op.name).Observe(time.Since(op.start).Seconds())
+	if !isFailure(err) {
+		err = nil
+	}
+	if err != nil {
+		metrics.StorageErrors.WithLabelValues(op.s.backend, op.name).Inc()
+		logger.FromContext(op.ctx).Warn("storage operation failed",
+			zap.String("backend", op.s.backend), zap.String("operation", op.name), zap.Error(err))
+	}
+	tracing.End(op.span, err)
+}
+
+func isFailure(err error) bool {
+	if err == nil || errors.Is(err, t.ErrNotFound) {
+		return false
+	}
+	var urlConflictError *t.URLConflictError
+	return !errors.As(err, &urlConflictError)
+}
@@ -3,36 +3,214 @@ package memory
 import (
 	"context"
 	t "github.com/repriest/url-shortener/internal/storage/types"
+	"maps"
+	"slices"
+	"sync"
 )
 
 type MemoryStorage struct {
+	mu      sync.RWMutex
 	entries []t.URLEntry
+	version uint64 // incremented on every change
+	reports []t.Report
+	// revisions are kept per short URL, oldest first
+	revisions map[string][]t.Revision
+	// clicks are counted per short URL and variant
+	clicks map[string]map[string]int64
+
+	snap *snapshotter
 }
 
 func NewMemoryStorage() (*MemoryStorage, error) {
 	return &MemoryStorage{
-		entries: []t.URLEntry{},
+		entries:   []t.URLEntry{},
+		revisions: make(map[string][]t.Revision),
+		clicks:    make(map[string]map[string]int64),
 	}, nil
 }
 
-func (s *MemoryStorage) Load() ([]t.URLEntry, error) {
-	return s.entries, nil
+func (s *MemoryStorage) Load(_ context.Context) ([]t.URLEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries := make([]t.URLEntry, len(s.entries))
+	copy(entries, s.entries)
+	return entries, nil
+}
+
+func (s *MemoryStorage) Get(_ context.Context, shortURL string) (t.URLEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, ok := s.find(shortURL)
+	if !ok {
+		return t.URLEntry{}, t.ErrNotFound
+	}
+	return entry, nil
+}
+
+// find returns the entry for shortURL. Callers hold s.mu.
+func (s *MemoryStorage) find(shortURL string) (t.URLEntry, bool) {
+	// latest entry wins
+	for i := len(s.entries) - 1; i >= 0; i-- {
+		if s.entries[i].ShortURL == shortURL {
+			return s.entries[i], true
+		}
+	}
+	return t.URLEntry{}, false
+}
+
+// checkNew returns t.ErrShortURLTaken if the short URL of a new entry is
+// used by a link to another URL. Callers hold s.mu.
+func (s *MemoryStorage) checkNew(entries []t.URLEntry) error {
+	for _, entry := range entries {
+		if existing, ok := s.find(entry.ShortURL); ok && t.EntryHash(existing) != t.EntryHash(entry) {
+			return t.ErrShortURLTaken
+		}
+	}
+	return nil
 }
 
-func (s *MemoryStorage) Append(entry t.URLEntry) error {
+func (s *MemoryStorage) GetMany(_ context.Context, shortURLs []string) (map[string]t.URLEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	wanted := make(map[string]bool, len(shortURLs))
+	for _, shortURL := range shortURLs {
+		wanted[shortURL] = true
+	}
+	found := make(map[string]t.URLEntry)
+	// later entries overwrite earlier ones, so the latest wins like in Get
+	for _, entry := range s.entries {
+		if wanted[entry.ShortURL] {
+			found[entry.ShortURL] = entry
+		}
+	}
+	return found, nil
+}
+
+// findHash returns the short URL of the entry with urlHash. Callers hold s.mu.
+func (s *MemoryStorage) findHash(urlHash string) (string, bool) {
+	for _, entry := range s.entries {
+		if t.EntryHash(entry) == urlHash {
+			return entry.ShortURL, true
+		}
+	}
+	return "", false
+}
+
+func (s *MemoryStorage) Append(_ context.Context, entry t.URLEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if shortURL, ok := s.findHash(t.EntryHash(entry)); ok {
+		return &t.URLConflictError{ShortURL: shortURL}
+	}
+	if err := s.checkNew([]t.URLEntry{entry}); err != nil {
+		return err
+	}
 	s.entries = append(s.entries, entry)
+	s.version++
 	return nil
 }
 
-func (s *MemoryStorage) BatchAppend(entries []t.URLEntry) error {
-	s.entries = append(s.entries, entries...)
+// BatchAppend skips entries whose URL is already shortened, as postgres does.
+func (s *MemoryStorage) BatchAppend(_ context.Context, entries []t.URLEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkNew(entries); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if _, ok := s.findHash(t.EntryHash(entry)); ok {
+			continue
+		}
+		s.entries = append(s.entries, entry)
+	}
+	s.version++
 	return nil
 }
 
-func (s *MemoryStorage) Close() error {
+func (s *MemoryStorage) Update(_ context.Context, entry t.URLEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.update(entry)
+}
+
+// update replaces the entry with the same ShortURL. Callers hold s.mu.
+func (s *MemoryStorage) update(entry t.URLEntry) error {
+	found := false
+	for i := range s.entries {
+		if s.entries[i].ShortURL == entry.ShortURL {
+			s.entries[i] = entry
+			found = true
+		}
+	}
+	if !found {
+		return t.ErrNotFound
+	}
+	s.version++
+	return nil
+}
+
+func (s *MemoryStorage) SetFailedOver(_ context.Context, shortURL string, failedOver bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.find(shortURL)
+	if !ok {
+		return t.ErrNotFound
+	}
+	entry.FailedOver = failedOver
+	return s.update(entry)
+}
+
+func (s *MemoryStorage) FindByURLHash(_ context.Context, urlHash string) ([]t.URLEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	found := []t.URLEntry{}
+	seen := make(map[string]bool)
+	// latest entry wins
+	for i := len(s.entries) - 1; i >= 0; i-- {
+		entry := s.entries[i]
+		if seen[entry.ShortURL] {
+			continue
+		}
+		seen[entry.ShortURL] = true
+		if t.EntryHash(entry) == urlHash {
+			found = append(found, entry)
+		}
+	}
+	slices.Reverse(found)
+	return found, nil
+}
+
+func (s *MemoryStorage) AddClick(_ context.Context, shortURL, variant string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.clicks[shortURL] == nil {
+		s.clicks[shortURL] = make(map[string]int64)
+	}
+	s.clicks[shortURL][variant]++
+	s.version++
 	return nil
 }
 
+func (s *MemoryStorage) Clicks(_ context.Context, shortURL string) (map[string]int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return maps.Clone(s.clicks[shortURL]), nil
+}
+
+func (s *MemoryStorage) Close() error {
+	return s.closeSnapshots()
+}
+
 func (s *MemoryStorage) Ping(ctx context.Context) error {
 	return nil
 }
@@ -0,0 +1,45 @@
+package memory
+
+import (
+	"context"
+	t "github.com/repriest/url-shortener/internal/storage/types"
+)
+
+func (s *MemoryStorage) AddReport(_ context.Context, report t.Report) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reports = append(s.reports, report)
+	s.version++
+	return nil
+}
+
+func (s *MemoryStorage) Reports(_ context.Context, status string) ([]t.Report, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	reports := []t.Report{}
+	for _, r := range s.reports {
+		if status == "" || r.Status == status {
+			reports = append(reports, r)
+		}
+	}
+	return reports, nil
+}
+
+func (s *MemoryStorage) ResolveReports(_ context.Context, shortURL, status string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resolved := 0
+	for i := range s.reports {
+		if s.reports[i].ShortURL == shortURL && s.reports[i].Status == t.ReportOpen {
+			s.reports[i].Status = status
+			resolved++
+		}
+	}
+	if resolved > 0 {
+		s.version++
+	}
+	return resolved, nil
+}
@@ -0,0 +1,26 @@
+package memory
+
+import (
+	"context"
+	t "github.com/repriest/url-shortener/internal/storage/types"
+)
+
+func (s *MemoryStorage) Revise(_ context.Context, entry t.URLEntry, rev t.Revision) (t.Revision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.update(entry); err != nil {
+		return t.Revision{}, err
+	}
+	rev.ShortURL = entry.ShortURL
+	rev.Version = len(s.revisions[entry.ShortURL]) + 1
+	s.revisions[entry.ShortURL] = append(s.revisions[entry.ShortURL], rev)
+	return rev, nil
+}
+
+func (s *MemoryStorage) Revisions(_ context.Context, shortURL string) ([]t.Revision, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]t.Revision{}, s.revisions[shortURL]...), nil
+}
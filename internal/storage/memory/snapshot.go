@@ -0,0 +1,238 @@
+package memory
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/repriest/url-shortener/internal/logger"
+	t "github.com/repriest/url-shortener/internal/storage/types"
+	"go.uber.org/zap"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// snapshotter periodically saves a MemoryStorage to a gzip-compressed
+// JSON lines file and saves it once more on close.
+type snapshotter struct {
+	path  string
+	saved uint64 // version of the last saved snapshot
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// snapshotData is everything a MemoryStorage keeps.
+type snapshotData struct {
+	entries   []t.URLEntry
+	reports   []t.Report
+	revisions map[string][]t.Revision
+	clicks    map[string]map[string]int64
+}
+
+// snapshotRecord is a line of the snapshot file, exactly one field is set.
+// Snapshots written before reports, revisions and clicks were saved hold
+// bare entries instead.
+type snapshotRecord struct {
+	Entry    *t.URLEntry  `json:"entry,omitempty"`
+	Report   *t.Report    `json:"report,omitempty"`
+	Revision *t.Revision  `json:"revision,omitempty"`
+	Clicks   *clickRecord `json:"clicks,omitempty"`
+}
+
+type clickRecord struct {
+	ShortURL string `json:"short_url"`
+	Variant  string `json:"variant,omitempty"`
+	Count    int64  `json:"count"`
+}
+
+// NewSnapshotMemoryStorage restores the snapshot at path, if any, and saves
+// the storage back every interval and on Close.
+func NewSnapshotMemoryStorage(path string, interval time.Duration) (*MemoryStorage, error) {
+	s, err := NewMemoryStorage()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := readSnapshot(path)
+	if err != nil {
+		return nil, err
+	}
+	s.entries = data.entries
+	s.reports = data.reports
+	s.revisions = data.revisions
+	s.clicks = data.clicks
+
+	s.snap = &snapshotter{path: path, stop: make(chan struct{})}
+	s.snap.wg.Add(1)
+	go s.runSnapshots(interval)
+
+	return s, nil
+}
+
+func (s *MemoryStorage) runSnapshots(interval time.Duration) {
+	defer s.snap.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.snap.stop:
+			return
+		case <-ticker.C:
+			if err := s.snapshot(); err != nil {
+				logger.Log.Error("could not save memory snapshot", zap.Error(err))
+			}
+		}
+	}
+}
+
+// snapshot writes the storage to the snapshot file if it changed since the
+// last snapshot. The file is replaced atomically.
+func (s *MemoryStorage) snapshot() error {
+	if s.snap == nil {
+		return nil
+	}
+
+	s.mu.RLock()
+	version := s.version
+	if version == s.snap.saved {
+		s.mu.RUnlock()
+		return nil
+	}
+	// revisions are only appended, so sharing their slices is safe
+	data := snapshotData{
+		entries:   slices.Clone(s.entries),
+		reports:   slices.Clone(s.reports),
+		revisions: maps.Clone(s.revisions),
+		clicks:    make(map[string]map[string]int64, len(s.clicks)),
+	}
+	for shortURL, counts := range s.clicks {
+		data.clicks[shortURL] = maps.Clone(counts)
+	}
+	s.mu.RUnlock()
+
+	if err := writeSnapshot(s.snap.path, data); err != nil {
+		return err
+	}
+	s.snap.saved = version
+	return nil
+}
+
+func (s *MemoryStorage) closeSnapshots() error {
+	if s.snap == nil {
+		return nil
+	}
+	close(s.snap.stop)
+	s.snap.wg.Wait()
+	return s.snapshot()
+}
+
+func writeSnapshot(path string, data snapshotData) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot file: %w", err)
+	}
+	// no-op after a successful rename
+	defer os.Remove(tmp.Name())
+
+	if err := encodeSnapshot(tmp, data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close snapshot: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace snapshot: %w", err)
+	}
+	return nil
+}
+
+func encodeSnapshot(w io.Writer, data snapshotData) error {
+	zw := gzip.NewWriter(w)
+	enc := json.NewEncoder(zw)
+	for _, entry := range data.entries {
+		if err := enc.Encode(snapshotRecord{Entry: &entry}); err != nil {
+			return err
+		}
+	}
+	for _, report := range data.reports {
+		if err := enc.Encode(snapshotRecord{Report: &report}); err != nil {
+			return err
+		}
+	}
+	for _, shortURL := range slices.Sorted(maps.Keys(data.revisions)) {
+		for _, rev := range data.revisions[shortURL] {
+			if err := enc.Encode(snapshotRecord{Revision: &rev}); err != nil {
+				return err
+			}
+		}
+	}
+	for _, shortURL := range slices.Sorted(maps.Keys(data.clicks)) {
+		for _, variant := range slices.Sorted(maps.Keys(data.clicks[shortURL])) {
+			rec := clickRecord{ShortURL: shortURL, Variant: variant, Count: data.clicks[shortURL][variant]}
+			if err := enc.Encode(snapshotRecord{Clicks: &rec}); err != nil {
+				return err
+			}
+		}
+	}
+	return zw.Close()
+}
+
+func readSnapshot(path string) (snapshotData, error) {
+	data := snapshotData{
+		entries:   []t.URLEntry{},
+		revisions: make(map[string][]t.Revision),
+		clicks:    make(map[string]map[string]int64),
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return data, nil
+		}
+		return data, fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return data, fmt.Errorf("failed to read snapshot %s: %w", path, err)
+	}
+	defer zr.Close()
+
+	dec := json.NewDecoder(zr)
+	for {
+		var rec snapshotRecord
+		err := dec.Decode(&rec)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return data, fmt.Errorf("failed to decode snapshot %s: %w", path, err)
+		}
+
+		switch {
+		case rec.Entry != nil:
+			data.entries = append(data.entries, *rec.Entry)
+		case rec.Report != nil:
+			data.reports = append(data.reports, *rec.Report)
+		case rec.Revision != nil:
+			data.revisions[rec.Revision.ShortURL] = append(data.revisions[rec.Revision.ShortURL], *rec.Revision)
+		case rec.Clicks != nil:
+			if data.clicks[rec.Clicks.ShortURL] == nil {
+				data.clicks[rec.Clicks.ShortURL] = make(map[string]int64)
+			}
+			data.clicks[rec.Clicks.ShortURL][rec.Clicks.Variant] = rec.Clicks.Count
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,67 @@
+package memory
+
+import (
+	"context"
+	"github.com/repriest/url-shortener/internal/storage/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "snapshot.ndjson.gz")
+
+	// saved periodically
+	s, err := NewSnapshotMemoryStorage(path, 10*time.Millisecond)
+	require.NoError(t, err)
+	entry := types.URLEntry{UUID: "1", ShortURL: "abc", OriginalURL: "https://example.com"}
+	require.NoError(t, s.Append(ctx, entry))
+	require.Eventually(t, func() bool {
+		data, err := readSnapshot(path)
+		return err == nil && len(data.entries) == 1
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, s.Close())
+
+	// saved on close, long before the next tick
+	s, err = NewSnapshotMemoryStorage(path, time.Hour)
+	require.NoError(t, err)
+	report := types.Report{ID: "r1", ShortURL: "abc", Reason: "spam", Status: types.ReportOpen, CreatedAt: time.Now().UTC()}
+	require.NoError(t, s.AddReport(ctx, report))
+	edited := entry
+	edited.OriginalURL = "https://example.com/new"
+	rev, err := s.Revise(ctx, edited, types.Revision{Author: "u1", Old: entry.Version(), New: edited.Version()})
+	require.NoError(t, err)
+	require.NoError(t, s.AddClick(ctx, "abc", "a"))
+	require.NoError(t, s.AddClick(ctx, "abc", "a"))
+	require.NoError(t, s.AddClick(ctx, "abc", ""))
+	require.NoError(t, s.Close())
+
+	// restored on boot
+	s, err = NewSnapshotMemoryStorage(path, time.Hour)
+	require.NoError(t, err)
+	defer s.Close()
+
+	got, err := s.Get(ctx, "abc")
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/new", got.OriginalURL)
+	reports, err := s.Reports(ctx, "")
+	require.NoError(t, err)
+	require.Len(t, reports, 1)
+	assert.Equal(t, report.Reason, reports[0].Reason)
+	revs, err := s.Revisions(ctx, "abc")
+	require.NoError(t, err)
+	require.Len(t, revs, 1)
+	assert.Equal(t, rev.Version, revs[0].Version)
+	assert.Equal(t, "https://example.com/new", revs[0].New.OriginalURL)
+	clicks, err := s.Clicks(ctx, "abc")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"a": 2, "": 1}, clicks)
+
+	// a new revision continues the restored history
+	rev, err = s.Revise(ctx, entry, types.Revision{Author: "u1", Old: edited.Version(), New: entry.Version()})
+	require.NoError(t, err)
+	assert.Equal(t, 2, rev.Version)
+}
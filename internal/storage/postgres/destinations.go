@@ -0,0 +1,70 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	t "github.com/repriest/url-shortener/internal/storage/types"
+)
+
+// querier is implemented by both *sql.DB and *sql.Tx.
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+func getDestinations(ctx context.Context, q querier, shortURL string) ([]t.Destination, error) {
+	all, err := queryDestinations(ctx, q, `
+		SELECT short_url, id, url, weight FROM destinations
+		WHERE short_url = $1 ORDER BY position
+	`, shortURL)
+	if err != nil {
+		return nil, err
+	}
+	return all[shortURL], nil
+}
+
+func allDestinations(ctx context.Context, q querier) (map[string][]t.Destination, error) {
+	return queryDestinations(ctx, q, `
+		SELECT short_url, id, url, weight FROM destinations
+		ORDER BY short_url, position
+	`)
+}
+
+func queryDestinations(ctx context.Context, q querier, query string, args ...any) (map[string][]t.Destination, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query destinations: %w", err)
+	}
+	defer rows.Close()
+
+	dests := make(map[string][]t.Destination)
+	for rows.Next() {
+		var shortURL string
+		var d t.Destination
+		if err := rows.Scan(&shortURL, &d.ID, &d.URL, &d.Weight); err != nil {
+			return nil, fmt.Errorf("failed to scan destination: %w", err)
+		}
+		dests[shortURL] = append(dests[shortURL], d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read destinations: %w", err)
+	}
+	return dests, nil
+}
+
+func replaceDestinations(ctx context.Context, q querier, shortURL string, dests []t.Destination) error {
+	if _, err := q.ExecContext(ctx, "DELETE FROM destinations WHERE short_url = $1", shortURL); err != nil {
+		return fmt.Errorf("failed to delete destinations: %w", err)
+	}
+	for i, d := range dests {
+		_, err := q.ExecContext(ctx, `
+			INSERT INTO destinations (short_url, id, url, weight, position)
+			VALUES ($1, $2, $3, $4, $5)
+		`, shortURL, d.ID, d.URL, d.Weight, i)
+		if err != nil {
+			return fmt.Errorf("failed to insert destination: %w", err)
+		}
+	}
+	return nil
+}
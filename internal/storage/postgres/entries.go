@@ -0,0 +1,164 @@
+package postgres
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	t "github.com/repriest/url-shortener/internal/storage/types"
+	"strings"
+)
+
+// entryFields are the urls columns besides uuid, in the order of entryValues.
+const entryFields = "short_url, original_url, key_id, url_hash, redirect_code, tracked, " +
+	"forward_query, query_precedence, forward_path, sticky, rules, app_link, password_hash, " +
+	"interstitial, created_at, disabled, disabled_reason, fallback_url, failed_over, " +
+	"owner_id, metadata"
+
+var (
+	selectQuery = "SELECT uuid, " + entryFields + " FROM urls"
+
+	insertQuery = fmt.Sprintf(`
+		INSERT INTO urls (uuid, %s)
+		VALUES (%s)
+		ON CONFLICT (url_hash) DO NOTHING
+	`, entryFields, placeholders(1, fieldCount()+1))
+
+	updateQuery = fmt.Sprintf(`
+		UPDATE urls SET (%s) = (%s)
+		WHERE short_url = $1
+	`, entryFields, placeholders(1, fieldCount()))
+)
+
+func entryValues(entry t.URLEntry) ([]any, error) {
+	rules, err := json.Marshal(entry.Rules)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal rules: %w", err)
+	}
+	if entry.Rules == nil {
+		rules = []byte("[]")
+	}
+
+	// links without an app link store NULL
+	var appLink any
+	if entry.AppLink != nil {
+		b, err := json.Marshal(entry.AppLink)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal app link: %w", err)
+		}
+		appLink = string(b)
+	}
+
+	metadata, err := json.Marshal(entry.Metadata)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal metadata: %w", err)
+	}
+	if entry.Metadata == nil {
+		metadata = []byte("{}")
+	}
+
+	return []any{
+		entry.ShortURL,
+		entry.OriginalURL,
+		entry.KeyID,
+		t.EntryHash(entry),
+		entry.RedirectCode,
+		entry.Tracked,
+		entry.ForwardQuery,
+		entry.QueryPrecedence,
+		entry.ForwardPath,
+		entry.Sticky,
+		string(rules),
+		appLink,
+		entry.PasswordHash,
+		entry.Interstitial,
+		sql.NullTime{Time: entry.CreatedAt, Valid: !entry.CreatedAt.IsZero()},
+		entry.Disabled,
+		entry.DisabledReason,
+		entry.FallbackURL,
+		entry.FailedOver,
+		entry.OwnerID,
+		string(metadata),
+	}, nil
+}
+
+func insertArgs(entry t.URLEntry) ([]any, error) {
+	values, err := entryValues(entry)
+	if err != nil {
+		return nil, err
+	}
+	return append([]any{entry.UUID}, values...), nil
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// scanEntry scans a row selected with selectQuery.
+func scanEntry(row scanner) (t.URLEntry, error) {
+	entry := t.URLEntry{}
+	var rules, appLink, metadata []byte
+	var createdAt sql.NullTime
+	err := row.Scan(
+		&entry.UUID,
+		&entry.ShortURL,
+		&entry.OriginalURL,
+		&entry.KeyID,
+		&entry.URLHash,
+		&entry.RedirectCode,
+		&entry.Tracked,
+		&entry.ForwardQuery,
+		&entry.QueryPrecedence,
+		&entry.ForwardPath,
+		&entry.Sticky,
+		&rules,
+		&appLink,
+		&entry.PasswordHash,
+		&entry.Interstitial,
+		&createdAt,
+		&entry.Disabled,
+		&entry.DisabledReason,
+		&entry.FallbackURL,
+		&entry.FailedOver,
+		&entry.OwnerID,
+		&metadata,
+	)
+	if err != nil {
+		return entry, err
+	}
+	if err := json.Unmarshal(rules, &entry.Rules); err != nil {
+		return entry, fmt.Errorf("failed to unmarshal rules: %w", err)
+	}
+	entry.CreatedAt = createdAt.Time
+	if len(entry.Rules) == 0 {
+		entry.Rules = nil
+	}
+	if err := json.Unmarshal(metadata, &entry.Metadata); err != nil {
+		return entry, fmt.Errorf("failed to unmarshal metadata: %w", err)
+	}
+	if len(entry.Metadata) == 0 {
+		entry.Metadata = nil
+	}
+	if appLink != nil {
+		entry.AppLink = &t.AppLink{}
+		if err := json.Unmarshal(appLink, entry.AppLink); err != nil {
+			return entry, fmt.Errorf("failed to unmarshal app link: %w", err)
+		}
+	}
+	return entry, nil
+}
+
+func fieldCount() int {
+	return strings.Count(entryFields, ",") + 1
+}
+
+// placeholders returns "$from, ..., $to".
+func placeholders(from, to int) string {
+	var b strings.Builder
+	for i := from; i <= to; i++ {
+		if i > from {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "$%d", i)
+	}
+	return b.String()
+}
@@ -0,0 +1,107 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	t "github.com/repriest/url-shortener/internal/storage/types"
+	"time"
+)
+
+func (s PGStorage) FindByURLHash(ctx context.Context, urlHash string) ([]t.URLEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var entries []t.URLEntry
+	err := withRetry(ctx, func() error {
+		var err error
+		entries, err = s.findByURLHash(ctx, urlHash)
+		return err
+	})
+	return entries, err
+}
+
+func (s PGStorage) findByURLHash(ctx context.Context, urlHash string) ([]t.URLEntry, error) {
+	db := s.replicas.reader()
+	rows, err := db.QueryContext(ctx, selectQuery+" WHERE url_hash = $1 ORDER BY short_url", urlHash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query urls: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []t.URLEntry{}
+	for rows.Next() {
+		entry, err := scanEntry(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read rows: %w", err)
+	}
+
+	dests, err := queryDestinations(ctx, db, `
+		SELECT short_url, id, url, weight FROM destinations
+		WHERE short_url IN (SELECT short_url FROM urls WHERE url_hash = $1)
+		ORDER BY short_url, position
+	`, urlHash)
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		entries[i].Destinations = dests[entries[i].ShortURL]
+	}
+	return entries, nil
+}
+
+func (s PGStorage) AddClick(ctx context.Context, shortURL, variant string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	err := withRetry(ctx, func() error {
+		_, err := s.db.ExecContext(ctx, `
+			INSERT INTO clicks (short_url, variant, count) VALUES ($1, $2, 1)
+			ON CONFLICT (short_url, variant) DO UPDATE SET count = clicks.count + 1
+		`, shortURL, variant)
+		if err != nil {
+			return fmt.Errorf("failed to count click: %w", err)
+		}
+		return nil
+	})
+	return asReadOnly(err)
+}
+
+func (s PGStorage) Clicks(ctx context.Context, shortURL string) (map[string]int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var counts map[string]int64
+	err := withRetry(ctx, func() error {
+		var err error
+		counts, err = s.clicks(ctx, shortURL)
+		return err
+	})
+	return counts, err
+}
+
+func (s PGStorage) clicks(ctx context.Context, shortURL string) (map[string]int64, error) {
+	rows, err := s.replicas.reader().QueryContext(ctx, "SELECT variant, count FROM clicks WHERE short_url = $1", shortURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query clicks: %w", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int64)
+	for rows.Next() {
+		var variant string
+		var count int64
+		if err := rows.Scan(&variant, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan clicks: %w", err)
+		}
+		counts[variant] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read clicks: %w", err)
+	}
+	return counts, nil
+}
@@ -0,0 +1,110 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// migrations are applied in order on every start, so each one must be idempotent.
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS urls (
+		uuid TEXT PRIMARY KEY,
+		short_url TEXT NOT NULL,
+		original_url TEXT NOT NULL UNIQUE
+	)`,
+
+	// duplicates are detected by url hash, so original_url may be stored encrypted
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS key_id TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS url_hash TEXT`,
+	`UPDATE urls SET url_hash = encode(sha256(convert_to(original_url, 'UTF8')), 'hex') WHERE url_hash IS NULL`,
+	`ALTER TABLE urls ALTER COLUMN url_hash SET NOT NULL`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS urls_url_hash_key ON urls (url_hash)`,
+	`ALTER TABLE urls DROP CONSTRAINT IF EXISTS urls_original_url_key`,
+
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS redirect_code INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS tracked BOOLEAN NOT NULL DEFAULT false`,
+
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS forward_query BOOLEAN NOT NULL DEFAULT false`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS query_precedence TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS forward_path BOOLEAN NOT NULL DEFAULT false`,
+
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS sticky BOOLEAN NOT NULL DEFAULT false`,
+	`CREATE TABLE IF NOT EXISTS destinations (
+		short_url TEXT NOT NULL,
+		id TEXT NOT NULL,
+		url TEXT NOT NULL,
+		weight INTEGER NOT NULL,
+		position INTEGER NOT NULL,
+		PRIMARY KEY (short_url, id)
+	)`,
+
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS rules JSONB NOT NULL DEFAULT '[]'`,
+
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS app_link JSONB`,
+
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS password_hash TEXT NOT NULL DEFAULT ''`,
+
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS interstitial BOOLEAN NOT NULL DEFAULT false`,
+	// NULL for links created before creation times were recorded
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ`,
+
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS disabled BOOLEAN NOT NULL DEFAULT false`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS disabled_reason TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE IF NOT EXISTS reports (
+		id TEXT PRIMARY KEY,
+		short_url TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		comment TEXT NOT NULL,
+		reporter_email TEXT NOT NULL,
+		reporter_ip TEXT NOT NULL,
+		reporter_user_agent TEXT NOT NULL,
+		status TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS reports_status_idx ON reports (status, created_at)`,
+
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS fallback_url TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS failed_over BOOLEAN NOT NULL DEFAULT false`,
+
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS owner_id TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS metadata JSONB NOT NULL DEFAULT '{}'`,
+	`CREATE TABLE IF NOT EXISTS revisions (
+		short_url TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		author TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL,
+		old JSONB NOT NULL,
+		new JSONB NOT NULL,
+		key_id TEXT NOT NULL,
+		PRIMARY KEY (short_url, version)
+	)`,
+
+	`CREATE TABLE IF NOT EXISTS clicks (
+		short_url TEXT PRIMARY KEY,
+		count BIGINT NOT NULL
+	)`,
+
+	// clicks are counted per variant, empty for links without variants
+	`ALTER TABLE clicks ADD COLUMN IF NOT EXISTS variant TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE clicks DROP CONSTRAINT IF EXISTS clicks_pkey`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS clicks_short_url_variant_key ON clicks (short_url, variant)`,
+
+	// protected links are not found by their destination, see types.EntryHash
+	`UPDATE urls SET url_hash = 'protected:' || short_url WHERE password_hash <> '' AND url_hash <> 'protected:' || short_url`,
+
+	// short URLs are unique, links that took the code of an older one are dropped
+	`DELETE FROM urls a USING urls b WHERE a.short_url = b.short_url AND
+		(COALESCE(a.created_at, '-infinity'), a.uuid) > (COALESCE(b.created_at, '-infinity'), b.uuid)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS urls_short_url_key ON urls (short_url)`,
+	`DROP INDEX IF EXISTS urls_short_url_idx`,
+}
+
+func migrate(ctx context.Context, db *sql.DB) error {
+	for i, query := range migrations {
+		if _, err := db.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("failed to apply migration %d: %w", i, err)
+		}
+	}
+	return nil
+}
@@ -3,18 +3,26 @@ package postgres
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
+	"github.com/XSAM/otelsql"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
 	_ "github.com/jackc/pgx/v5/stdlib"
 	t "github.com/repriest/url-shortener/internal/storage/types"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 	"time"
 )
 
 type PGStorage struct {
-	db *sql.DB
+	db       *sql.DB
+	replicas *replicaSet
 }
 
-func NewPgStorage(dsn string) (*PGStorage, error) {
-	db, err := sql.Open("pgx", dsn)
+func NewPgStorage(dsn string, replicaDSNs []string, maxLag, checkInterval time.Duration) (*PGStorage, error) {
+	db, err := openDB(dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
@@ -24,27 +32,57 @@ func NewPgStorage(dsn string) (*PGStorage, error) {
 
 	err = db.PingContext(ctx)
 	if err != nil {
+		db.Close()
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS urls (
-			uuid TEXT PRIMARY KEY,
-			short_url TEXT NOT NULL,
-			original_url TEXT NOT NULL UNIQUE
-		)
-	`)
+	err = migrate(ctx, db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 
+	replicas, err := newReplicaSet(db, replicaDSNs, maxLag, checkInterval)
 	if err != nil {
 		db.Close()
-		return nil, fmt.Errorf("failed to create table urls: %w", err)
+		return nil, err
 	}
 
-	return &PGStorage{db: db}, nil
+	return &PGStorage{db: db, replicas: replicas}, nil
+}
+
+// openDB opens dsn with a span for each SQL statement. Statements are only
+// traced inside a traced storage call, so background replica checks and
+// migrations do not start traces of their own.
+func openDB(dsn string) (*sql.DB, error) {
+	return otelsql.Open("pgx", dsn,
+		otelsql.WithAttributes(semconv.DBSystemPostgreSQL),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{
+			OmitConnResetSession: true,
+			OmitRows:             true,
+			SpanFilter: func(ctx context.Context, _ otelsql.Method, _ string, _ []driver.NamedValue) bool {
+				return trace.SpanContextFromContext(ctx).IsValid()
+			},
+		}),
+	)
+}
+
+func (s PGStorage) Load(ctx context.Context) ([]t.URLEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var entries []t.URLEntry
+	err := withRetry(ctx, func() error {
+		var err error
+		entries, err = s.load(ctx)
+		return err
+	})
+	return entries, err
 }
 
-func (s PGStorage) Load() ([]t.URLEntry, error) {
-	rows, err := s.db.Query("SELECT uuid, short_url, original_url FROM urls")
+func (s PGStorage) load(ctx context.Context) ([]t.URLEntry, error) {
+	db := s.replicas.reader()
+	rows, err := db.QueryContext(ctx, selectQuery)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query urls: %w", err)
 	}
@@ -52,29 +90,132 @@ func (s PGStorage) Load() ([]t.URLEntry, error) {
 
 	var entries []t.URLEntry
 	for rows.Next() {
-		entry := t.URLEntry{}
-		err := rows.Scan(&entry.UUID, &entry.ShortURL, &entry.OriginalURL)
+		entry, err := scanEntry(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan row: %w", err)
 		}
 		entries = append(entries, entry)
 	}
-	if rows.Err() != nil {
+	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("failed to read rows: %w", err)
 	}
+
+	dests, err := allDestinations(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		entries[i].Destinations = dests[entries[i].ShortURL]
+	}
 	return entries, nil
 }
 
-func (s PGStorage) Append(entry t.URLEntry) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (s PGStorage) Get(ctx context.Context, shortURL string) (t.URLEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var entry t.URLEntry
+	err := withRetry(ctx, func() error {
+		var err error
+		entry, err = s.get(ctx, shortURL)
+		return err
+	})
+	return entry, err
+}
+
+func (s PGStorage) get(ctx context.Context, shortURL string) (t.URLEntry, error) {
+	db := s.replicas.reader()
+	row := db.QueryRowContext(ctx, selectQuery+" WHERE short_url = $1 LIMIT 1", shortURL)
+	entry, err := scanEntry(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return t.URLEntry{}, t.ErrNotFound
+	}
+	if err != nil {
+		return t.URLEntry{}, fmt.Errorf("failed to query url: %w", err)
+	}
+
+	entry.Destinations, err = getDestinations(ctx, db, shortURL)
+	if err != nil {
+		return t.URLEntry{}, err
+	}
+	return entry, nil
+}
+
+func (s PGStorage) GetMany(ctx context.Context, shortURLs []string) (map[string]t.URLEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var entries map[string]t.URLEntry
+	err := withRetry(ctx, func() error {
+		var err error
+		entries, err = s.getMany(ctx, shortURLs)
+		return err
+	})
+	return entries, err
+}
+
+// getMany reads the entries and their destinations with one query each.
+func (s PGStorage) getMany(ctx context.Context, shortURLs []string) (map[string]t.URLEntry, error) {
+	db := s.replicas.reader()
+	rows, err := db.QueryContext(ctx, selectQuery+" WHERE short_url = ANY($1)", shortURLs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query urls: %w", err)
+	}
+	defer rows.Close()
+
+	entries := make(map[string]t.URLEntry)
+	for rows.Next() {
+		entry, err := scanEntry(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		entries[entry.ShortURL] = entry
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read rows: %w", err)
+	}
+
+	dests, err := queryDestinations(ctx, db, `
+		SELECT short_url, id, url, weight FROM destinations
+		WHERE short_url = ANY($1) ORDER BY short_url, position
+	`, shortURLs)
+	if err != nil {
+		return nil, err
+	}
+	for shortURL, entry := range entries {
+		entry.Destinations = dests[shortURL]
+		entries[shortURL] = entry
+	}
+	return entries, nil
+}
+
+func (s PGStorage) Append(ctx context.Context, entry t.URLEntry) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
+	err := withRetry(ctx, func() error {
+		return s.append(ctx, entry)
+	})
+	return asReadOnly(err)
+}
+
+func (s PGStorage) append(ctx context.Context, entry t.URLEntry) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	args, err := insertArgs(entry)
+	if err != nil {
+		return err
+	}
+
 	// try to insert entry
-	result, err := s.db.ExecContext(ctx, `
-			INSERT INTO urls (uuid, short_url, original_url) 
-			VALUES ($1, $2, $3)
-			ON CONFLICT (original_url) DO NOTHING 
-		`, entry.UUID, entry.ShortURL, entry.OriginalURL)
+	result, err := tx.ExecContext(ctx, insertQuery, args...)
+	if isShortURLTaken(err) {
+		return t.ErrShortURLTaken
+	}
 	if err != nil {
 		return fmt.Errorf("failed to insert url: %w", err)
 	}
@@ -88,20 +229,35 @@ func (s PGStorage) Append(entry t.URLEntry) error {
 	// if nothing was inserted - return error with existing short url
 	if rowsAffected == 0 {
 		var existingShortURL string
-		err := s.db.QueryRowContext(ctx, "SELECT short_url FROM urls WHERE original_url = $1", entry.OriginalURL).Scan(&existingShortURL)
+		err := tx.QueryRowContext(ctx, "SELECT short_url FROM urls WHERE url_hash = $1", t.EntryHash(entry)).Scan(&existingShortURL)
 		if err != nil {
 			return fmt.Errorf("failed to query existing short url: %w", err)
 		}
 		return &t.URLConflictError{ShortURL: existingShortURL}
 	}
 
+	if err := replaceDestinations(ctx, tx, entry.ShortURL, entry.Destinations); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
 	return nil
 }
 
-func (s PGStorage) BatchAppend(entries []t.URLEntry) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (s PGStorage) BatchAppend(ctx context.Context, entries []t.URLEntry) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
+	// the whole transaction is retried, so a partially applied batch is never committed
+	err := withRetry(ctx, func() error {
+		return s.batchAppend(ctx, entries)
+	})
+	return asReadOnly(err)
+}
+
+func (s PGStorage) batchAppend(ctx context.Context, entries []t.URLEntry) error {
 	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("failed to begin transaction: %w", err)
@@ -109,11 +265,7 @@ func (s PGStorage) BatchAppend(entries []t.URLEntry) error {
 	defer tx.Rollback()
 
 	// prepare insert entry statement
-	stmt, err := tx.PrepareContext(ctx, `
-			INSERT INTO urls (uuid, short_url, original_url) 
-			VALUES ($1, $2, $3)
-			ON CONFLICT (original_url) DO NOTHING 
-		`)
+	stmt, err := tx.PrepareContext(ctx, insertQuery)
 	if err != nil {
 		return fmt.Errorf("failed to prepare statement: %w", err)
 	}
@@ -121,10 +273,31 @@ func (s PGStorage) BatchAppend(entries []t.URLEntry) error {
 
 	// execute insert entry statement
 	for _, entry := range entries {
-		_, err = stmt.ExecContext(ctx, entry.UUID, entry.ShortURL, entry.OriginalURL)
+		args, err := insertArgs(entry)
+		if err != nil {
+			return err
+		}
+		result, err := stmt.ExecContext(ctx, args...)
+		if isShortURLTaken(err) {
+			return t.ErrShortURLTaken
+		}
 		if err != nil {
 			return fmt.Errorf("failed to insert entry: %w", err)
 		}
+		if len(entry.Destinations) == 0 {
+			continue
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to get rows affected: %w", err)
+		}
+		// destinations of existing entries are left alone
+		if rowsAffected == 0 {
+			continue
+		}
+		if err := replaceDestinations(ctx, tx, entry.ShortURL, entry.Destinations); err != nil {
+			return err
+		}
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -134,7 +307,90 @@ func (s PGStorage) BatchAppend(entries []t.URLEntry) error {
 	return nil
 }
 
+func (s PGStorage) Update(ctx context.Context, entry t.URLEntry) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	err := withRetry(ctx, func() error {
+		return s.update(ctx, entry)
+	})
+	return asReadOnly(err)
+}
+
+func (s PGStorage) update(ctx context.Context, entry t.URLEntry) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := updateEntry(ctx, tx, entry); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+func (s PGStorage) SetFailedOver(ctx context.Context, shortURL string, failedOver bool) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	err := withRetry(ctx, func() error {
+		result, err := s.db.ExecContext(ctx, "UPDATE urls SET failed_over = $2 WHERE short_url = $1", shortURL, failedOver)
+		if err != nil {
+			return fmt.Errorf("failed to update url: %w", err)
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to get rows affected: %w", err)
+		}
+		if rowsAffected == 0 {
+			return t.ErrNotFound
+		}
+		return nil
+	})
+	return asReadOnly(err)
+}
+
+// isShortURLTaken reports whether err violates the unique index of short
+// URLs. Duplicate url hashes are skipped by insertQuery instead.
+func isShortURLTaken(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation && pgErr.ConstraintName == "urls_short_url_key"
+}
+
+func updateEntry(ctx context.Context, tx *sql.Tx, entry t.URLEntry) error {
+	values, err := entryValues(entry)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, updateQuery, values...)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+		// the new destination is already shortened by another link
+		return &t.URLConflictError{}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update url: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return t.ErrNotFound
+	}
+
+	return replaceDestinations(ctx, tx, entry.ShortURL, entry.Destinations)
+}
+
 func (s PGStorage) Close() error {
+	s.replicas.close()
 	return s.db.Close()
 }
 
@@ -0,0 +1,148 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/repriest/url-shortener/internal/logger"
+	"go.uber.org/zap"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// replicaLagQuery returns replication lag in seconds. An idle replica that has
+// replayed everything it received is reported as not lagging.
+const replicaLagQuery = `
+	SELECT CASE
+		WHEN NOT pg_is_in_recovery() THEN 0
+		WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+		ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+	END
+`
+
+type replica struct {
+	name    string
+	db      *sql.DB
+	healthy atomic.Bool
+}
+
+// replicaSet routes read queries to healthy replicas in round-robin order
+// and falls back to the primary when none are available.
+type replicaSet struct {
+	primary  *sql.DB
+	replicas []*replica
+	next     atomic.Uint64
+	maxLag   time.Duration
+	// lag measures how far a replica is behind, replicaLag outside of tests
+	lag func(ctx context.Context, db *sql.DB) (time.Duration, error)
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newReplicaSet(primary *sql.DB, dsns []string, maxLag, interval time.Duration) (*replicaSet, error) {
+	rs := &replicaSet{primary: primary, maxLag: maxLag, lag: replicaLag}
+	for i, dsn := range dsns {
+		db, err := openDB(dsn)
+		if err != nil {
+			rs.closeReplicas()
+			return nil, fmt.Errorf("failed to open replica %d: %w", i, err)
+		}
+		rs.replicas = append(rs.replicas, &replica{name: fmt.Sprintf("replica-%d", i), db: db})
+	}
+	if len(rs.replicas) == 0 {
+		return rs, nil
+	}
+
+	rs.checkAll(context.Background())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rs.cancel = cancel
+	rs.wg.Add(1)
+	go rs.run(ctx, interval)
+
+	return rs, nil
+}
+
+// reader returns a database handle for read-only queries.
+func (rs *replicaSet) reader() *sql.DB {
+	n := len(rs.replicas)
+	for i := 0; i < n; i++ {
+		r := rs.replicas[int(rs.next.Add(1)%uint64(n))]
+		if r.healthy.Load() {
+			return r.db
+		}
+	}
+	return rs.primary
+}
+
+func (rs *replicaSet) run(ctx context.Context, interval time.Duration) {
+	defer rs.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rs.checkAll(ctx)
+		}
+	}
+}
+
+func (rs *replicaSet) checkAll(ctx context.Context) {
+	for _, r := range rs.replicas {
+		err := rs.check(ctx, r)
+		healthy := err == nil
+		if r.healthy.Swap(healthy) != healthy {
+			if healthy {
+				logger.Log.Info("replica is healthy", zap.String("replica", r.name))
+			} else {
+				logger.Log.Warn("replica is unhealthy", zap.String("replica", r.name), zap.Error(err))
+			}
+		}
+	}
+}
+
+func (rs *replicaSet) check(ctx context.Context, r *replica) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	lag, err := rs.lag(ctx, r.db)
+	if err != nil {
+		return err
+	}
+	if lag > rs.maxLag {
+		return fmt.Errorf("replica lag %s exceeds %s", lag, rs.maxLag)
+	}
+	return nil
+}
+
+func replicaLag(ctx context.Context, db *sql.DB) (time.Duration, error) {
+	if err := db.PingContext(ctx); err != nil {
+		return 0, fmt.Errorf("failed to ping replica: %w", err)
+	}
+
+	var lagSeconds float64
+	if err := db.QueryRowContext(ctx, replicaLagQuery).Scan(&lagSeconds); err != nil {
+		return 0, fmt.Errorf("failed to query replica lag: %w", err)
+	}
+	return time.Duration(lagSeconds * float64(time.Second)), nil
+}
+
+func (rs *replicaSet) closeReplicas() {
+	for _, r := range rs.replicas {
+		r.db.Close()
+	}
+}
+
+// close stops health checks and closes replica connections. The primary is
+// owned by PGStorage and is not closed here.
+func (rs *replicaSet) close() {
+	if rs.cancel != nil {
+		rs.cancel()
+	}
+	rs.wg.Wait()
+	rs.closeReplicas()
+}
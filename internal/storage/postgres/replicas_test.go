@@ -0,0 +1,89 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDB returns a handle that is never connected, the lag check is stubbed.
+func fakeDB(t *testing.T, name string) *sql.DB {
+	db, err := sql.Open("pgx", "postgres://localhost/"+name)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestReplicaReader(t *testing.T) {
+	primary := fakeDB(t, "primary")
+	var mu sync.Mutex
+	lags := make(map[*sql.DB]time.Duration)
+	errDown := errors.New("failed to ping replica: connection refused")
+	down := make(map[*sql.DB]bool)
+
+	rs := &replicaSet{
+		primary: primary,
+		maxLag:  time.Second,
+		lag: func(_ context.Context, db *sql.DB) (time.Duration, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if down[db] {
+				return 0, errDown
+			}
+			return lags[db], nil
+		},
+	}
+	var dbs []*sql.DB
+	for i := range 3 {
+		db := fakeDB(t, fmt.Sprintf("replica%d", i))
+		dbs = append(dbs, db)
+		rs.replicas = append(rs.replicas, &replica{name: fmt.Sprintf("replica-%d", i), db: db})
+	}
+	readers := func() map[*sql.DB]int {
+		seen := make(map[*sql.DB]int)
+		for range 30 {
+			seen[rs.reader()]++
+		}
+		return seen
+	}
+
+	// reads are spread over healthy replicas
+	rs.checkAll(context.Background())
+	assert.Equal(t, map[*sql.DB]int{dbs[0]: 10, dbs[1]: 10, dbs[2]: 10}, readers())
+
+	// lagging and unreachable replicas are skipped
+	mu.Lock()
+	lags[dbs[0]] = 2 * time.Second
+	down[dbs[1]] = true
+	mu.Unlock()
+	rs.checkAll(context.Background())
+	assert.Equal(t, map[*sql.DB]int{dbs[2]: 30}, readers())
+	assert.ErrorIs(t, rs.check(context.Background(), rs.replicas[1]), errDown)
+	assert.ErrorContains(t, rs.check(context.Background(), rs.replicas[0]), "exceeds")
+
+	// the primary serves reads while no replica is healthy
+	mu.Lock()
+	down[dbs[2]] = true
+	mu.Unlock()
+	rs.checkAll(context.Background())
+	assert.Equal(t, map[*sql.DB]int{primary: 30}, readers())
+
+	// replicas are used again once they catch up
+	mu.Lock()
+	lags[dbs[0]] = time.Second
+	mu.Unlock()
+	rs.checkAll(context.Background())
+	assert.Equal(t, map[*sql.DB]int{dbs[0]: 30}, readers())
+}
+
+func TestReplicaReaderWithoutReplicas(t *testing.T) {
+	primary := fakeDB(t, "primary")
+	rs := &replicaSet{primary: primary}
+	assert.Same(t, primary, rs.reader())
+}
@@ -0,0 +1,91 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	t "github.com/repriest/url-shortener/internal/storage/types"
+	"time"
+)
+
+const reportFields = "id, short_url, reason, comment, reporter_email, reporter_ip, reporter_user_agent, status, created_at"
+
+func (s PGStorage) AddReport(ctx context.Context, report t.Report) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	err := withRetry(ctx, func() error {
+		_, err := s.db.ExecContext(ctx, `
+			INSERT INTO reports (`+reportFields+`)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			ON CONFLICT (id) DO NOTHING
+		`, report.ID, report.ShortURL, report.Reason, report.Comment, report.ReporterEmail,
+			report.ReporterIP, report.ReporterAgent, report.Status, report.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("failed to insert report: %w", err)
+		}
+		return nil
+	})
+	return asReadOnly(err)
+}
+
+func (s PGStorage) Reports(ctx context.Context, status string) ([]t.Report, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var reports []t.Report
+	err := withRetry(ctx, func() error {
+		var err error
+		reports, err = s.reports(ctx, status)
+		return err
+	})
+	return reports, err
+}
+
+func (s PGStorage) reports(ctx context.Context, status string) ([]t.Report, error) {
+	rows, err := s.replicas.reader().QueryContext(ctx, `
+		SELECT `+reportFields+` FROM reports
+		WHERE $1 = '' OR status = $1
+		ORDER BY created_at, id
+	`, status)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query reports: %w", err)
+	}
+	defer rows.Close()
+
+	reports := []t.Report{}
+	for rows.Next() {
+		var r t.Report
+		err := rows.Scan(&r.ID, &r.ShortURL, &r.Reason, &r.Comment, &r.ReporterEmail,
+			&r.ReporterIP, &r.ReporterAgent, &r.Status, &r.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan report: %w", err)
+		}
+		reports = append(reports, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read reports: %w", err)
+	}
+	return reports, nil
+}
+
+func (s PGStorage) ResolveReports(ctx context.Context, shortURL, status string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var resolved int64
+	err := withRetry(ctx, func() error {
+		result, err := s.db.ExecContext(ctx, `
+			UPDATE reports SET status = $2
+			WHERE short_url = $1 AND status = $3
+		`, shortURL, status, t.ReportOpen)
+		if err != nil {
+			return fmt.Errorf("failed to update reports: %w", err)
+		}
+		resolved, err = result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to get rows affected: %w", err)
+		}
+		return nil
+	})
+	return int(resolved), asReadOnly(err)
+}
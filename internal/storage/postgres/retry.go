@@ -0,0 +1,70 @@
+package postgres
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+	t "github.com/repriest/url-shortener/internal/storage/types"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	retryAttempts  = 3
+	retryBaseDelay = 50 * time.Millisecond
+	retryMaxDelay  = time.Second
+)
+
+// isRetryable reports whether err is transient: a dropped connection,
+// a serialization failure or a deadlock.
+func isRetryable(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgerrcode.IsConnectionException(pgErr.Code) ||
+			pgErr.Code == pgerrcode.SerializationFailure ||
+			pgErr.Code == pgerrcode.DeadlockDetected
+	}
+	return errors.Is(err, driver.ErrBadConn) || pgconn.SafeToRetry(err)
+}
+
+// asReadOnly marks errors caused by a read-only or full database with t.ErrReadOnly.
+func asReadOnly(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) &&
+		(pgErr.Code == pgerrcode.ReadOnlySQLTransaction || pgErr.Code == pgerrcode.DiskFull) {
+		return fmt.Errorf("%w: %w", t.ErrReadOnly, err)
+	}
+	return err
+}
+
+// withRetry runs op until it succeeds, fails with a non-transient error or
+// runs out of attempts, sleeping with jittered exponential backoff in between.
+func withRetry(ctx context.Context, op func() error) error {
+	var err error
+	for attempt := 0; attempt < retryAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(backoff(attempt)):
+			}
+		}
+		err = op()
+		if err == nil || !isRetryable(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func backoff(attempt int) time.Duration {
+	d := retryBaseDelay << (attempt - 1)
+	if d > retryMaxDelay {
+		d = retryMaxDelay
+	}
+	// random delay in [d/2, d)
+	return d/2 + rand.N(d/2)
+}
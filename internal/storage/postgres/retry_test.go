@@ -0,0 +1,102 @@
+package postgres
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/repriest/url-shortener/internal/storage/types"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"connection failure", &pgconn.PgError{Code: pgerrcode.ConnectionFailure}, true},
+		{"serialization failure", fmt.Errorf("failed to commit: %w", &pgconn.PgError{Code: pgerrcode.SerializationFailure}), true},
+		{"deadlock", &pgconn.PgError{Code: pgerrcode.DeadlockDetected}, true},
+		{"bad connection", fmt.Errorf("failed to query url: %w", driver.ErrBadConn), true},
+		{"unique violation", &pgconn.PgError{Code: pgerrcode.UniqueViolation}, false},
+		{"read-only", &pgconn.PgError{Code: pgerrcode.ReadOnlySQLTransaction}, false},
+		{"not found", types.ErrNotFound, false},
+		{"timeout", context.DeadlineExceeded, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, isRetryable(tt.err))
+		})
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	transient := &pgconn.PgError{Code: pgerrcode.SerializationFailure}
+
+	// transient errors are retried until the attempts run out
+	calls := 0
+	err := withRetry(context.Background(), func() error {
+		calls++
+		return transient
+	})
+	assert.ErrorIs(t, err, transient)
+	assert.Equal(t, retryAttempts, calls)
+
+	calls = 0
+	err = withRetry(context.Background(), func() error {
+		calls++
+		if calls == 1 {
+			return transient
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+
+	// other errors are returned at once
+	calls = 0
+	err = withRetry(context.Background(), func() error {
+		calls++
+		return types.ErrNotFound
+	})
+	assert.ErrorIs(t, err, types.ErrNotFound)
+	assert.Equal(t, 1, calls)
+
+	// no retries once the context is done, the last error is kept
+	ctx, cancel := context.WithCancel(context.Background())
+	calls = 0
+	err = withRetry(ctx, func() error {
+		calls++
+		cancel()
+		return transient
+	})
+	assert.ErrorIs(t, err, transient)
+	assert.Equal(t, 1, calls)
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := 1; attempt < 10; attempt++ {
+		d := retryBaseDelay << (attempt - 1)
+		if d > retryMaxDelay {
+			d = retryMaxDelay
+		}
+		for i := 0; i < 20; i++ {
+			got := backoff(attempt)
+			assert.GreaterOrEqual(t, got, d/2, attempt)
+			assert.Less(t, got, d, attempt)
+		}
+	}
+	assert.LessOrEqual(t, backoff(30), retryMaxDelay)
+	assert.Greater(t, backoff(30), time.Duration(0))
+}
+
+func TestAsReadOnly(t *testing.T) {
+	assert.ErrorIs(t, asReadOnly(&pgconn.PgError{Code: pgerrcode.ReadOnlySQLTransaction}), types.ErrReadOnly)
+	assert.ErrorIs(t, asReadOnly(fmt.Errorf("failed to insert url: %w", &pgconn.PgError{Code: pgerrcode.DiskFull})), types.ErrReadOnly)
+	assert.NotErrorIs(t, asReadOnly(&pgconn.PgError{Code: pgerrcode.UniqueViolation}), types.ErrReadOnly)
+	assert.NoError(t, asReadOnly(nil))
+}
@@ -0,0 +1,107 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	t "github.com/repriest/url-shortener/internal/storage/types"
+	"time"
+)
+
+// Revise updates the link and inserts the revision in one transaction. The
+// update locks the link row, so concurrent edits get consecutive versions.
+func (s PGStorage) Revise(ctx context.Context, entry t.URLEntry, rev t.Revision) (t.Revision, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	rev.ShortURL = entry.ShortURL
+	err := withRetry(ctx, func() error {
+		var err error
+		rev.Version, err = s.revise(ctx, entry, rev)
+		return err
+	})
+	return rev, asReadOnly(err)
+}
+
+func (s PGStorage) revise(ctx context.Context, entry t.URLEntry, rev t.Revision) (int, error) {
+	oldJSON, err := json.Marshal(rev.Old)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal revision: %w", err)
+	}
+	newJSON, err := json.Marshal(rev.New)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal revision: %w", err)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := updateEntry(ctx, tx, entry); err != nil {
+		return 0, err
+	}
+
+	var version int
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO revisions (short_url, version, author, created_at, old, new, key_id)
+		SELECT $1, COALESCE(MAX(version), 0) + 1, $2, $3, $4, $5, $6
+		FROM revisions WHERE short_url = $1
+		RETURNING version
+	`, rev.ShortURL, rev.Author, rev.CreatedAt, string(oldJSON), string(newJSON), rev.KeyID).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert revision: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return version, nil
+}
+
+func (s PGStorage) Revisions(ctx context.Context, shortURL string) ([]t.Revision, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var revisions []t.Revision
+	err := withRetry(ctx, func() error {
+		var err error
+		revisions, err = s.revisions(ctx, shortURL)
+		return err
+	})
+	return revisions, err
+}
+
+func (s PGStorage) revisions(ctx context.Context, shortURL string) ([]t.Revision, error) {
+	rows, err := s.replicas.reader().QueryContext(ctx, `
+		SELECT short_url, version, author, created_at, old, new, key_id FROM revisions
+		WHERE short_url = $1
+		ORDER BY version
+	`, shortURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query revisions: %w", err)
+	}
+	defer rows.Close()
+
+	revisions := []t.Revision{}
+	for rows.Next() {
+		var rev t.Revision
+		var oldJSON, newJSON []byte
+		err := rows.Scan(&rev.ShortURL, &rev.Version, &rev.Author, &rev.CreatedAt, &oldJSON, &newJSON, &rev.KeyID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan revision: %w", err)
+		}
+		if err := json.Unmarshal(oldJSON, &rev.Old); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal revision: %w", err)
+		}
+		if err := json.Unmarshal(newJSON, &rev.New); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal revision: %w", err)
+		}
+		revisions = append(revisions, rev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read revisions: %w", err)
+	}
+	return revisions, nil
+}
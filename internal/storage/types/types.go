@@ -2,9 +2,27 @@ package types
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"time"
 )
 
+// ErrUnavailable is returned when storage refuses requests without trying,
+// e.g. while a circuit breaker is open.
+var ErrUnavailable = errors.New("storage is temporarily unavailable")
+
+// ErrReadOnly is returned when storage cannot accept writes, e.g. after a
+// database failover or when the disk is full.
+var ErrReadOnly = errors.New("storage is read-only")
+
+var ErrNotFound = errors.New("url not found")
+
+// ErrShortURLTaken is returned when a new entry's short URL is used by a
+// link to another destination, e.g. one that was edited since.
+var ErrShortURLTaken = errors.New("short url is already taken")
+
 type URLConflictError struct {
 	ShortURL string
 }
@@ -17,12 +35,221 @@ type URLEntry struct {
 	UUID        string `json:"uuid"`
 	ShortURL    string `json:"short_url"`
 	OriginalURL string `json:"original_url"`
+	// KeyID is the keyring key OriginalURL is encrypted with, empty for plaintext
+	KeyID string `json:"key_id,omitempty"`
+	// URLHash identifies OriginalURL for duplicate detection, see HashURL
+	URLHash string `json:"url_hash,omitempty"`
+	// RedirectCode overrides the server default redirect status when set
+	RedirectCode int `json:"redirect_code,omitempty"`
+	// Tracked links are never cached by clients, so every visit reaches the server
+	Tracked bool `json:"tracked,omitempty"`
+	// ForwardQuery merges the request query into OriginalURL, QueryPrecedence
+	// decides which side wins on key clashes
+	ForwardQuery    bool   `json:"forward_query,omitempty"`
+	QueryPrecedence string `json:"query_precedence,omitempty"`
+	// ForwardPath appends path segments after the short code to OriginalURL
+	ForwardPath bool `json:"forward_path,omitempty"`
+	// Destinations replace OriginalURL as redirect targets, one is picked per
+	// request by weight. Sticky visitors keep getting the same destination.
+	Destinations []Destination `json:"destinations,omitempty"`
+	Sticky       bool          `json:"sticky,omitempty"`
+	// Rules are evaluated in order before destinations, the first match wins
+	Rules []Rule `json:"rules,omitempty"`
+	// AppLink opens a mobile app instead of the web destination
+	AppLink *AppLink `json:"app_link,omitempty"`
+	// PasswordHash is the bcrypt hash of the link password, empty for public links
+	PasswordHash string `json:"password_hash,omitempty"`
+	// Interstitial links show a preview page instead of redirecting
+	Interstitial bool      `json:"interstitial,omitempty"`
+	CreatedAt    time.Time `json:"created_at,omitzero"`
+	// Disabled links are taken down by moderators and no longer redirect
+	Disabled       bool   `json:"disabled,omitempty"`
+	DisabledReason string `json:"disabled_reason,omitempty"`
+	// FallbackURL replaces OriginalURL while the health checker finds it
+	// failing, FailedOver is set during that time
+	FallbackURL string `json:"fallback_url,omitempty"`
+	FailedOver  bool   `json:"failed_over,omitempty"`
+	// OwnerID is the user who created the link, only the owner may edit it
+	OwnerID  string            `json:"owner_id,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Version returns the fields of entry that are kept in revisions.
+func (e URLEntry) Version() LinkVersion {
+	return LinkVersion{OriginalURL: e.OriginalURL, RedirectCode: e.RedirectCode, Metadata: e.Metadata}
+}
+
+// SetVersion replaces the fields of entry that are kept in revisions. The
+// URLHash of the old URL is dropped, so the new one is hashed on write.
+func (e *URLEntry) SetVersion(v LinkVersion) {
+	if v.OriginalURL != e.OriginalURL {
+		e.URLHash = ""
+	}
+	e.OriginalURL = v.OriginalURL
+	e.RedirectCode = v.RedirectCode
+	e.Metadata = v.Metadata
+}
+
+// AppLink holds per-platform app URIs. The store URL is the fallback when
+// the app is not installed, the web destination is used without one.
+type AppLink struct {
+	IOSURL          string `json:"ios_url,omitempty"`
+	IOSStoreURL     string `json:"ios_store_url,omitempty"`
+	AndroidURL      string `json:"android_url,omitempty"`
+	AndroidStoreURL string `json:"android_store_url,omitempty"`
+}
+
+// Rule redirects matching requests to its own destination. Empty conditions
+// match everything, a condition with several values matches any of them.
+type Rule struct {
+	ID        string   `json:"id,omitempty"`
+	Devices   []string `json:"devices,omitempty"`
+	Languages []string `json:"languages,omitempty"`
+	Countries []string `json:"countries,omitempty"`
+	// NotBefore and NotAfter bound the rule in time
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	NotAfter  *time.Time `json:"not_after,omitempty"`
+	// Hours is a daily "15:04-15:04" window in UTC, it may wrap past midnight
+	Hours       string `json:"hours,omitempty"`
+	Destination string `json:"destination"`
+}
+
+// Destination is a weighted variant of a link's target.
+type Destination struct {
+	ID     string `json:"id"`
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+// Report statuses. Open reports wait in the moderation queue.
+const (
+	ReportOpen      = "open"
+	ReportActioned  = "actioned"
+	ReportDismissed = "dismissed"
+)
+
+// Report is an abuse report about a short link.
+type Report struct {
+	ID            string    `json:"id"`
+	ShortURL      string    `json:"short_url"`
+	Reason        string    `json:"reason"`
+	Comment       string    `json:"comment,omitempty"`
+	ReporterEmail string    `json:"reporter_email,omitempty"`
+	ReporterIP    string    `json:"reporter_ip,omitempty"`
+	ReporterAgent string    `json:"reporter_user_agent,omitempty"`
+	Status        string    `json:"status"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// LinkVersion holds the editable fields of a link.
+type LinkVersion struct {
+	OriginalURL  string            `json:"original_url"`
+	RedirectCode int               `json:"redirect_code,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+}
+
+// Revision is an immutable record of a link edit. Versions of a link count
+// up from 1, version 0 is the link as it was created.
+type Revision struct {
+	ShortURL  string      `json:"short_url"`
+	Version   int         `json:"version"`
+	Author    string      `json:"author"`
+	CreatedAt time.Time   `json:"created_at"`
+	Old       LinkVersion `json:"old"`
+	New       LinkVersion `json:"new"`
+	// KeyID is the keyring key the URLs are encrypted with, empty for plaintext
+	KeyID string `json:"key_id,omitempty"`
+}
+
+// HashURL is the unkeyed URLHash used when encryption is disabled.
+func HashURL(originalURL string) string {
+	sum := sha256.Sum256([]byte(originalURL))
+	return hex.EncodeToString(sum[:])
+}
+
+// EntryHash returns the URLHash of entry, falling back to the unkeyed one
+// for entries that were not hashed by the encryption layer. Protected links
+// hash their short URL instead, so they are never found by their
+// destination nor taken as duplicates of it.
+func EntryHash(entry URLEntry) string {
+	if entry.PasswordHash != "" {
+		return "protected:" + entry.ShortURL
+	}
+	if entry.URLHash != "" {
+		return entry.URLHash
+	}
+	return HashURL(entry.OriginalURL)
 }
 
 type Storage interface {
-	Load() ([]URLEntry, error)
-	Append(entry URLEntry) error
-	BatchAppend(entries []URLEntry) error
+	Load(ctx context.Context) ([]URLEntry, error)
+	// Get returns the entry for shortURL or ErrNotFound
+	Get(ctx context.Context, shortURL string) (URLEntry, error)
+	// GetMany returns the entries of shortURLs that exist, by short URL
+	GetMany(ctx context.Context, shortURLs []string) (map[string]URLEntry, error)
+	Append(ctx context.Context, entry URLEntry) error
+	BatchAppend(ctx context.Context, entries []URLEntry) error
+	// Update replaces the entry with the same ShortURL
+	Update(ctx context.Context, entry URLEntry) error
+	// FindByURLHash returns the entries whose EntryHash equals urlHash
+	FindByURLHash(ctx context.Context, urlHash string) ([]URLEntry, error)
+	// AddClick counts a visit of shortURL that was served variant, empty
+	// for links without variants. Clicks returns the counts by variant.
+	AddClick(ctx context.Context, shortURL, variant string) error
+	Clicks(ctx context.Context, shortURL string) (map[string]int64, error)
 	Close() error
 	Ping(ctx context.Context) error
 }
+
+// ReportStorage is implemented by backends that keep abuse reports.
+type ReportStorage interface {
+	AddReport(ctx context.Context, report Report) error
+	// Reports returns reports with the given status, all if empty, oldest first
+	Reports(ctx context.Context, status string) ([]Report, error)
+	// ResolveReports sets the status of the open reports of shortURL and
+	// returns how many were changed
+	ResolveReports(ctx context.Context, shortURL, status string) (int, error)
+}
+
+// FailoverStorage is implemented by backends that can switch a link to its
+// fallback URL without rewriting the rest of it.
+type FailoverStorage interface {
+	SetFailedOver(ctx context.Context, shortURL string, failedOver bool) error
+}
+
+// URLHasher is implemented by storage wrappers that store a keyed URLHash
+// instead of HashURL.
+type URLHasher interface {
+	HashURL(originalURL string) string
+}
+
+// ShortCoder is implemented by storage wrappers that hide OriginalURL, so
+// short codes must not encode it.
+type ShortCoder interface {
+	ShortCode(originalURL string) string
+}
+
+// RevisionStorage is implemented by backends that keep link history.
+type RevisionStorage interface {
+	// Revise updates entry like Update and records rev with the next version
+	// of the link, which is returned
+	Revise(ctx context.Context, entry URLEntry, rev Revision) (Revision, error)
+	// Revisions returns the revisions of shortURL, oldest first
+	Revisions(ctx context.Context, shortURL string) ([]Revision, error)
+}
+
+// As finds a storage of type T in the chain of storage wrappers, starting
+// with st and following their Unwrap methods.
+func As[T any](st Storage) (T, bool) {
+	for {
+		if found, ok := st.(T); ok {
+			return found, true
+		}
+		u, ok := st.(interface{ Unwrap() Storage })
+		if !ok {
+			var zero T
+			return zero, false
+		}
+		st = u.Unwrap()
+	}
+}
@@ -0,0 +1,28 @@
+package tracing
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.ndjson")
+	shutdown, err := Init(Options{Exporter: "file", FilePath: path, SampleRatio: 1})
+	require.NoError(t, err)
+
+	_, span := Tracer("test").Start(context.Background(), "test-span")
+	span.End()
+	require.NoError(t, shutdown(context.Background()))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"Name":"test-span"`)
+	assert.Contains(t, string(data), span.SpanContext().TraceID().String())
+
+	_, err = Init(Options{Exporter: "jaeger"})
+	assert.ErrorContains(t, err, "unknown trace exporter")
+}
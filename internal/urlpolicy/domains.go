@@ -0,0 +1,132 @@
+package urlpolicy
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/repriest/url-shortener/internal/logger"
+	"go.uber.org/zap"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DomainList holds allow and deny rules read from a file with lines like
+// "allow example.com" or "deny bad.example", "#" starts a comment. A rule
+// covers the domain and its subdomains. Deny rules win, and once any allow
+// rule exists only allowed domains are accepted.
+type DomainList struct {
+	path   string
+	reload time.Duration
+
+	mu      sync.Mutex
+	allow   []string
+	deny    []string
+	modTime time.Time
+	checked time.Time
+}
+
+// NewDomainList reads the list at path. A list that cannot be read is
+// logged and retried on the next check, ValidateDomainList catches broken
+// files at startup.
+func NewDomainList(path string, reload time.Duration) *DomainList {
+	l := &DomainList{path: path, reload: reload}
+	l.mu.Lock()
+	l.reloadIfChanged()
+	l.mu.Unlock()
+	return l
+}
+
+// ValidateDomainList reports whether the file at path is a valid domain list.
+func ValidateDomainList(path string) error {
+	_, _, _, err := readDomainList(path)
+	return err
+}
+
+func (l *DomainList) check(host string) error {
+	l.mu.Lock()
+	l.reloadIfChanged()
+	allow, deny := l.allow, l.deny
+	l.mu.Unlock()
+
+	if matchDomain(deny, host) {
+		return &Violation{CodeDomainDenied, fmt.Sprintf("domain %q is denied", host)}
+	}
+	if len(allow) > 0 && !matchDomain(allow, host) {
+		return &Violation{CodeDomainNotAllowed, fmt.Sprintf("domain %q is not allowed", host)}
+	}
+	return nil
+}
+
+// reloadIfChanged re-reads the file when its modification time changed. A
+// file that cannot be read keeps the previous rules in place.
+func (l *DomainList) reloadIfChanged() {
+	if time.Since(l.checked) < l.reload {
+		return
+	}
+	l.checked = time.Now()
+
+	info, err := os.Stat(l.path)
+	if err != nil {
+		logger.Log.Error("could not stat domain list", zap.String("path", l.path), zap.Error(err))
+		return
+	}
+	if info.ModTime().Equal(l.modTime) {
+		return
+	}
+	allow, deny, modTime, err := readDomainList(l.path)
+	if err != nil {
+		logger.Log.Error("could not load domain list", zap.String("path", l.path), zap.Error(err))
+		return
+	}
+	l.allow, l.deny, l.modTime = allow, deny, modTime
+	logger.Log.Info("domain list loaded", zap.String("path", l.path), zap.Int("allow", len(l.allow)), zap.Int("deny", len(l.deny)))
+}
+
+func readDomainList(path string) ([]string, []string, time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, time.Time{}, fmt.Errorf("failed to open domain list: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, time.Time{}, fmt.Errorf("failed to stat domain list: %w", err)
+	}
+
+	var allow, deny []string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, nil, time.Time{}, fmt.Errorf("domain list line %d: expected \"allow|deny domain\"", n)
+		}
+		domain := strings.ToLower(strings.Trim(fields[1], "."))
+		switch fields[0] {
+		case "allow":
+			allow = append(allow, domain)
+		case "deny":
+			deny = append(deny, domain)
+		default:
+			return nil, nil, time.Time{}, fmt.Errorf("domain list line %d: unknown action %q", n, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, time.Time{}, fmt.Errorf("failed to read domain list: %w", err)
+	}
+	return allow, deny, info.ModTime(), nil
+}
+
+func matchDomain(domains []string, host string) bool {
+	for _, d := range domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package urlpolicy
+
+import (
+	"fmt"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Violation codes returned to API clients.
+const (
+	CodeSchemeNotAllowed = "scheme_not_allowed"
+	CodeTooLong          = "url_too_long"
+	CodeSelfReference    = "self_reference"
+	CodePrivateHost      = "private_host"
+	CodeDomainDenied     = "domain_denied"
+	CodeDomainNotAllowed = "domain_not_allowed"
+)
+
+// Violation is returned for URLs that parse but are not accepted.
+type Violation struct {
+	Code    string
+	Message string
+}
+
+func (v *Violation) Error() string {
+	return v.Message
+}
+
+// numericHost matches hosts such as "2130706433" or "0x7f.1" that browsers
+// resolve to IP addresses although they are not written as one.
+var numericHost = regexp.MustCompile(`^(0x[0-9a-f]+|[0-9]+)(\.(0x[0-9a-f]+|[0-9]+))*\.?$`)
+
+type Options struct {
+	Schemes           []string
+	MaxLength         int
+	BaseURL           string
+	AllowPrivateHosts bool
+	// DomainListPath is re-read at most every DomainListReload when it changes
+	DomainListPath   string
+	DomainListReload time.Duration
+}
+
+// Policy decides which destinations may be shortened.
+type Policy struct {
+	schemes      map[string]bool
+	maxLength    int
+	self         string
+	allowPrivate bool
+	domains      *DomainList
+}
+
+func New(opts Options) *Policy {
+	p := &Policy{
+		schemes:      make(map[string]bool),
+		maxLength:    opts.MaxLength,
+		allowPrivate: opts.AllowPrivateHosts,
+	}
+	for _, s := range opts.Schemes {
+		p.schemes[strings.ToLower(s)] = true
+	}
+	if u, err := url.Parse(opts.BaseURL); err == nil {
+		p.self = hostPort(u)
+	}
+	if opts.DomainListPath != "" {
+		p.domains = NewDomainList(opts.DomainListPath, opts.DomainListReload)
+	}
+	return p
+}
+
+// Check returns a *Violation if rawURL, which must already parse, is not allowed.
+func (p *Policy) Check(rawURL string) error {
+	if p.maxLength > 0 && len(rawURL) > p.maxLength {
+		return &Violation{CodeTooLong, fmt.Sprintf("URL is longer than %d characters", p.maxLength)}
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if !p.schemes[scheme] {
+		return &Violation{CodeSchemeNotAllowed, fmt.Sprintf("scheme %q is not allowed", u.Scheme)}
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "" {
+		return nil
+	}
+	if p.self != "" && hostPort(u) == p.self {
+		return &Violation{CodeSelfReference, "URL points back to this shortener"}
+	}
+	if !p.allowPrivate && isPrivate(host) {
+		return &Violation{CodePrivateHost, fmt.Sprintf("host %q is private or loopback", host)}
+	}
+	if p.domains != nil {
+		return p.domains.check(host)
+	}
+	return nil
+}
+
+// isPrivate reports whether host names the local machine or a private
+// network. Hostnames are not resolved, so this only catches literal addresses.
+func isPrivate(host string) bool {
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		// non-canonical numeric hosts are rejected instead of decoded
+		return numericHost.MatchString(host)
+	}
+	return IsPrivateAddr(addr)
+}
+
+// IsPrivateAddr reports whether addr belongs to the local machine or a
+// private network.
+func IsPrivateAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast()
+}
+
+// hostPort returns "host:port" with the scheme's default port filled in.
+func hostPort(u *url.URL) string {
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	port := u.Port()
+	if port == "" {
+		switch strings.ToLower(u.Scheme) {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		}
+	}
+	return host + ":" + port
+}
@@ -0,0 +1,81 @@
+package urlpolicy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheck(t *testing.T) {
+	p := New(Options{
+		Schemes:   []string{"http", "https"},
+		MaxLength: 40,
+		BaseURL:   "https://sho.rt",
+	})
+
+	tt := []struct {
+		name string
+		url  string
+		want string
+	}{
+		{name: "Allowed", url: "https://example.com/a"},
+		{name: "SchemeCase", url: "HTTPS://example.com"},
+		{name: "JavaScript", url: "javascript:alert(1)", want: CodeSchemeNotAllowed},
+		{name: "Data", url: "data:text/html,hi", want: CodeSchemeNotAllowed},
+		{name: "File", url: "file:///etc/passwd", want: CodeSchemeNotAllowed},
+		{name: "TooLong", url: "https://example.com/aaaaaaaaaaaaaaaaaaaaaaa", want: CodeTooLong},
+		{name: "Self", url: "https://sho.rt/abc", want: CodeSelfReference},
+		{name: "SelfDefaultPort", url: "https://SHO.RT:443/abc", want: CodeSelfReference},
+		{name: "SelfOtherPort", url: "https://sho.rt:8443/abc"},
+		{name: "Localhost", url: "http://localhost:8080", want: CodePrivateHost},
+		{name: "Loopback", url: "http://127.0.0.1/", want: CodePrivateHost},
+		{name: "Private", url: "http://10.1.2.3/", want: CodePrivateHost},
+		{name: "LinkLocal", url: "http://169.254.169.254/", want: CodePrivateHost},
+		{name: "IPv6Loopback", url: "http://[::1]/", want: CodePrivateHost},
+		{name: "Mapped", url: "http://[::ffff:127.0.0.1]/", want: CodePrivateHost},
+		{name: "Decimal", url: "http://2130706433/", want: CodePrivateHost},
+		{name: "Hex", url: "http://0x7f.1/", want: CodePrivateHost},
+		{name: "Public", url: "http://8.8.8.8/"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			err := p.Check(tc.url)
+			if tc.want == "" {
+				assert.NoError(t, err)
+				return
+			}
+			var v *Violation
+			require.ErrorAs(t, err, &v)
+			assert.Equal(t, tc.want, v.Code)
+		})
+	}
+}
+
+func TestDomainList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "domains.txt")
+	require.NoError(t, os.WriteFile(path, []byte("# blocked\ndeny bad.example\n"), 0o644))
+	require.NoError(t, ValidateDomainList(path))
+
+	p := New(Options{Schemes: []string{"https"}, DomainListPath: path})
+	assert.NoError(t, p.Check("https://good.example"))
+	assert.Error(t, p.Check("https://bad.example"))
+	assert.Error(t, p.Check("https://www.bad.example"))
+	assert.NoError(t, p.Check("https://notbad.example"))
+
+	// reloaded when the file changes
+	require.NoError(t, os.WriteFile(path, []byte("allow good.example\n"), 0o644))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+	assert.NoError(t, p.Check("https://api.good.example"))
+	var v *Violation
+	require.ErrorAs(t, p.Check("https://other.example"), &v)
+	assert.Equal(t, CodeDomainNotAllowed, v.Code)
+
+	// broken files keep the previous rules
+	require.NoError(t, os.WriteFile(path, []byte("block good.example\n"), 0o644))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(2*time.Minute)))
+	assert.Error(t, ValidateDomainList(path))
+	assert.NoError(t, p.Check("https://good.example"))
+}
@@ -0,0 +1,170 @@
+package urlservice
+
+import (
+	"fmt"
+	"golang.org/x/net/idna"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+type CanonicalOptions struct {
+	// SortQuery orders query params by key, keeping the order of repeated keys
+	SortQuery bool
+	// StripTracking removes utm_* and click ID params
+	StripTracking bool
+}
+
+// trackingParams are click IDs added by ad and mail platforms.
+var trackingParams = map[string]bool{
+	"fbclid":  true,
+	"gclid":   true,
+	"dclid":   true,
+	"msclkid": true,
+	"mc_eid":  true,
+	"yclid":   true,
+}
+
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+	"ftp":   "21",
+}
+
+// Canonicalize rewrites rawURL so equivalent URLs produce the same short
+// code: scheme and host are lowercased, default ports dropped, IDN hosts
+// converted to punycode and percent-encoding normalized. An empty path is
+// left empty.
+func Canonicalize(rawURL string, opts CanonicalOptions) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	// url.Parse already lowercases the scheme
+	if u.Opaque != "" || u.Host == "" {
+		return u.String(), nil
+	}
+
+	host, err := canonicalHost(u.Hostname())
+	if err != nil {
+		return "", err
+	}
+	if port := u.Port(); port != "" && port != defaultPorts[u.Scheme] {
+		host += ":" + port
+	}
+
+	var b strings.Builder
+	b.WriteString(u.Scheme)
+	b.WriteString("://")
+	if u.User != nil {
+		b.WriteString(u.User.String())
+		b.WriteByte('@')
+	}
+	b.WriteString(host)
+	b.WriteString(normalizeEscapes(u.EscapedPath()))
+	if query := canonicalQuery(u.RawQuery, opts); query != "" {
+		b.WriteByte('?')
+		b.WriteString(query)
+	}
+	if u.Fragment != "" {
+		b.WriteByte('#')
+		b.WriteString(normalizeEscapes(u.EscapedFragment()))
+	}
+	return b.String(), nil
+}
+
+func canonicalHost(host string) (string, error) {
+	// IPv6 literals keep their brackets
+	if strings.Contains(host, ":") {
+		return "[" + strings.ToLower(host) + "]", nil
+	}
+	for i := 0; i < len(host); i++ {
+		if host[i] >= 0x80 {
+			ascii, err := idna.Lookup.ToASCII(host)
+			if err != nil {
+				return "", fmt.Errorf("invalid host %q: %w", host, err)
+			}
+			return ascii, nil
+		}
+	}
+	return strings.ToLower(host), nil
+}
+
+// canonicalQuery normalizes the escaping of each raw "key=value" pair and
+// optionally drops tracking params and sorts by key. Pairs are not decoded
+// and re-encoded, so "+" and "%20" stay distinct.
+func canonicalQuery(rawQuery string, opts CanonicalOptions) string {
+	var parts []string
+	for _, part := range splitQuery(rawQuery) {
+		part = normalizeEscapes(part)
+		if opts.StripTracking && isTracking(rawKey(part)) {
+			continue
+		}
+		parts = append(parts, part)
+	}
+	if opts.SortQuery {
+		slices.SortStableFunc(parts, func(a, b string) int {
+			return strings.Compare(rawKey(a), rawKey(b))
+		})
+	}
+	return strings.Join(parts, "&")
+}
+
+func isTracking(key string) bool {
+	key = strings.ToLower(key)
+	return strings.HasPrefix(key, "utm_") || trackingParams[key]
+}
+
+// rawKey returns the key of a "key=value" pair, unescaped if possible.
+func rawKey(part string) string {
+	key, _, _ := strings.Cut(part, "=")
+	if unescaped, err := url.QueryUnescape(key); err == nil {
+		return unescaped
+	}
+	return key
+}
+
+// normalizeEscapes decodes percent-encoded unreserved characters and
+// uppercases the hex digits of the remaining escapes (RFC 3986, 6.2.2).
+// Malformed escapes are left alone.
+func normalizeEscapes(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+			b.WriteByte(s[i])
+			continue
+		}
+		c := unhex(s[i+1])<<4 | unhex(s[i+2])
+		if isUnreserved(c) {
+			b.WriteByte(c)
+		} else {
+			b.WriteByte('%')
+			b.WriteString(strings.ToUpper(s[i+1 : i+3]))
+		}
+		i += 2
+	}
+	return b.String()
+}
+
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
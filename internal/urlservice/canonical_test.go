@@ -0,0 +1,87 @@
+package urlservice
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestCanonicalize(t *testing.T) {
+	tt := []struct {
+		name string
+		url  string
+		opts CanonicalOptions
+		want string
+	}{
+		{
+			name: "Unchanged",
+			url:  "https://google.com",
+			want: "https://google.com",
+		},
+		{
+			name: "CaseAndDefaultPort",
+			url:  "HTTP://Example.COM:80/A/b",
+			want: "http://example.com/A/b",
+		},
+		{
+			name: "OtherPort",
+			url:  "https://example.com:8443",
+			want: "https://example.com:8443",
+		},
+		{
+			name: "IDN",
+			url:  "https://Bücher.example/straße",
+			want: "https://xn--bcher-kva.example/stra%C3%9Fe",
+		},
+		{
+			name: "IPv6",
+			url:  "http://[2001:DB8::1]:80/",
+			want: "http://[2001:db8::1]/",
+		},
+		{
+			name: "PercentEncoding",
+			url:  "https://example.com/%7euser/a%2fb?q=%7e%2a",
+			want: "https://example.com/~user/a%2Fb?q=~%2A",
+		},
+		{
+			name: "QueryKeptByDefault",
+			url:  "https://example.com/a?b=2&a=1&utm_source=mail",
+			want: "https://example.com/a?b=2&a=1&utm_source=mail",
+		},
+		{
+			name: "SortQuery",
+			url:  "https://example.com/a?b=2&a=1&b=1",
+			opts: CanonicalOptions{SortQuery: true},
+			want: "https://example.com/a?a=1&b=2&b=1",
+		},
+		{
+			name: "StripTracking",
+			url:  "https://example.com/a?utm_source=mail&id=1&fbclid=x&UTM_Medium=y",
+			opts: CanonicalOptions{StripTracking: true},
+			want: "https://example.com/a?id=1",
+		},
+		{
+			name: "StripAllParams",
+			url:  "https://example.com/a?gclid=1#top",
+			opts: CanonicalOptions{StripTracking: true},
+			want: "https://example.com/a#top",
+		},
+		{
+			name: "PlusStaysPlus",
+			url:  "https://example.com/?q=a+b&r=a%20b",
+			want: "https://example.com/?q=a+b&r=a%20b",
+		},
+		{
+			name: "Opaque",
+			url:  "MAILTO:me@example.com",
+			want: "mailto:me@example.com",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Canonicalize(tc.url, tc.opts)
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package urlservice
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+const (
+	// QueryPrecedenceDestination keeps destination params on key clashes (default)
+	QueryPrecedenceDestination = "destination"
+	// QueryPrecedenceRequest lets incoming params replace destination ones
+	QueryPrecedenceRequest = "request"
+)
+
+type ForwardOptions struct {
+	Query           bool
+	QueryPrecedence string
+	Path            bool
+}
+
+var ErrInvalidSuffix = errors.New("invalid path suffix")
+
+// Forward adds the escaped path suffix and raw query of an incoming request
+// to destination. Destination's own path and query are kept byte for byte,
+// so signed URLs stay valid unless request params are allowed to override them.
+func Forward(destination, escapedSuffix, rawQuery string, opts ForwardOptions) (string, error) {
+	dest, err := url.Parse(destination)
+	if err != nil {
+		return "", err
+	}
+
+	if opts.Path && escapedSuffix != "" {
+		if err := joinPath(dest, escapedSuffix); err != nil {
+			return "", err
+		}
+	}
+
+	if opts.Query && rawQuery != "" {
+		merged, err := mergeQuery(dest.RawQuery, rawQuery, opts.QueryPrecedence)
+		if err != nil {
+			return "", err
+		}
+		dest.RawQuery = merged
+	}
+
+	return dest.String(), nil
+}
+
+func joinPath(dest *url.URL, escapedSuffix string) error {
+	for _, segment := range strings.Split(escapedSuffix, "/") {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			return ErrInvalidSuffix
+		}
+		// dot segments would let the suffix climb out of the destination path
+		if unescaped == "." || unescaped == ".." || strings.Contains(unescaped, "/") {
+			return ErrInvalidSuffix
+		}
+	}
+
+	escaped := strings.TrimSuffix(dest.EscapedPath(), "/") + "/" + escapedSuffix
+	path, err := url.PathUnescape(escaped)
+	if err != nil {
+		return ErrInvalidSuffix
+	}
+	dest.Path = path
+	dest.RawPath = escaped
+	return nil
+}
+
+// mergeQuery appends request params to the destination query. Params are
+// copied as raw "key=value" pairs to keep their original escaping.
+func mergeQuery(destQuery, reqQuery, precedence string) (string, error) {
+	reqValues, err := url.ParseQuery(reqQuery)
+	if err != nil {
+		return "", err
+	}
+	destValues, err := url.ParseQuery(destQuery)
+	if err != nil {
+		return "", err
+	}
+
+	var parts []string
+	for _, part := range splitQuery(destQuery) {
+		if _, clash := reqValues[queryKey(part)]; clash && precedence == QueryPrecedenceRequest {
+			continue
+		}
+		parts = append(parts, part)
+	}
+	for _, part := range splitQuery(reqQuery) {
+		if _, clash := destValues[queryKey(part)]; clash && precedence != QueryPrecedenceRequest {
+			continue
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, "&"), nil
+}
+
+func splitQuery(query string) []string {
+	var parts []string
+	for _, part := range strings.Split(query, "&") {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// queryKey returns the unescaped key of a raw "key=value" pair. The query
+// was validated with url.ParseQuery, so unescaping cannot fail.
+func queryKey(part string) string {
+	key, _, _ := strings.Cut(part, "=")
+	key, _ = url.QueryUnescape(key)
+	return key
+}
@@ -0,0 +1,103 @@
+package urlservice
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestForward(t *testing.T) {
+	tt := []struct {
+		name        string
+		destination string
+		suffix      string
+		query       string
+		opts        ForwardOptions
+		want        string
+		wantErr     bool
+	}{
+		{
+			name:        "Disabled",
+			destination: "https://example.com/a?x=1",
+			suffix:      "b",
+			query:       "utm_source=mail",
+			want:        "https://example.com/a?x=1",
+		},
+		{
+			name:        "AppendQuery",
+			destination: "https://example.com/a?x=1",
+			query:       "utm_source=mail&utm_campaign=spring%20sale",
+			opts:        ForwardOptions{Query: true},
+			want:        "https://example.com/a?x=1&utm_source=mail&utm_campaign=spring%20sale",
+		},
+		{
+			name:        "DestinationWins",
+			destination: "https://example.com/a?x=1&sig=a%2Bb",
+			query:       "x=2&y=3",
+			opts:        ForwardOptions{Query: true},
+			want:        "https://example.com/a?x=1&sig=a%2Bb&y=3",
+		},
+		{
+			name:        "RequestWins",
+			destination: "https://example.com/a?x=1&x=4&sig=a%2Bb",
+			query:       "x=2&y=3",
+			opts:        ForwardOptions{Query: true, QueryPrecedence: QueryPrecedenceRequest},
+			want:        "https://example.com/a?sig=a%2Bb&x=2&y=3",
+		},
+		{
+			name:        "EncodedKeyClash",
+			destination: "https://example.com/?a%20b=1",
+			query:       "a+b=2",
+			opts:        ForwardOptions{Query: true},
+			want:        "https://example.com/?a%20b=1",
+		},
+		{
+			name:        "EncodedSlash",
+			destination: "https://example.com/docs/",
+			suffix:      "guide/caf%C3%A9%2Fmenu",
+			opts:        ForwardOptions{Path: true},
+			wantErr:     true,
+		},
+		{
+			name:        "PathSuffixEscaped",
+			destination: "https://example.com/docs",
+			suffix:      "guide/caf%C3%A9/a%20b",
+			opts:        ForwardOptions{Path: true},
+			want:        "https://example.com/docs/guide/caf%C3%A9/a%20b",
+		},
+		{
+			name:        "PathAndQuery",
+			destination: "https://example.com?x=1",
+			suffix:      "p",
+			query:       "y=2",
+			opts:        ForwardOptions{Path: true, Query: true},
+			want:        "https://example.com/p?x=1&y=2",
+		},
+		{
+			name:        "DotSegments",
+			destination: "https://example.com/docs",
+			suffix:      "%2e%2e/admin",
+			opts:        ForwardOptions{Path: true},
+			wantErr:     true,
+		},
+		{
+			name:        "InvalidQuery",
+			destination: "https://example.com/",
+			query:       "a=%zz",
+			opts:        ForwardOptions{Query: true},
+			wantErr:     true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Forward(tc.destination, tc.suffix, tc.query, tc.opts)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
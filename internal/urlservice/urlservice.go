@@ -1,6 +1,7 @@
 package urlservice
 
 import (
+	"crypto/rand"
 	"encoding/base64"
 	"net/url"
 )
@@ -13,6 +14,14 @@ func ShortenURL(longURL string) (string, error) {
 	return shortURL, nil
 }
 
+// RandomCode returns a code that is not derived from any URL. It is never
+// valid standard base64, so ExpandURL cannot decode it.
+func RandomCode() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
 func ExpandURL(shortURL string) (string, error) {
 	longURLBytes, err := base64.StdEncoding.DecodeString(shortURL)
 	if err != nil {
@@ -0,0 +1,62 @@
+package useragent
+
+import (
+	"regexp"
+	"strings"
+)
+
+const (
+	DeviceDesktop = "desktop"
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+	DeviceBot     = "bot"
+)
+
+const (
+	PlatformIOS     = "ios"
+	PlatformAndroid = "android"
+)
+
+var (
+	botPattern     = regexp.MustCompile(`(?i)bot|crawl|spider|slurp|curl|wget|facebookexternalhit|preview`)
+	tabletPattern  = regexp.MustCompile(`(?i)ipad|tablet|kindle|silk|playbook`)
+	mobilePattern  = regexp.MustCompile(`(?i)mobi|iphone|ipod|android|windows phone|blackberry|opera mini`)
+	androidPattern = regexp.MustCompile(`(?i)android`)
+	androidMobile  = regexp.MustCompile(`(?i)android.*mobile`)
+	iosPattern     = regexp.MustCompile(`(?i)iphone|ipad|ipod`)
+)
+
+// Device classifies a User-Agent header. Unknown agents are treated as desktop.
+func Device(userAgent string) string {
+	switch {
+	case botPattern.MatchString(userAgent):
+		return DeviceBot
+	case tabletPattern.MatchString(userAgent):
+		return DeviceTablet
+	// android tablets do not send "Mobile"
+	case androidMobile.MatchString(userAgent):
+		return DeviceMobile
+	case androidPattern.MatchString(userAgent):
+		return DeviceTablet
+	case mobilePattern.MatchString(userAgent):
+		return DeviceMobile
+	default:
+		return DeviceDesktop
+	}
+}
+
+// Platform returns the mobile OS of a User-Agent header, or "" for other
+// agents. Bots never get a platform so crawlers follow the web destination.
+func Platform(userAgent string) string {
+	switch {
+	case botPattern.MatchString(userAgent):
+		return ""
+	// Windows Phone claims to be Android
+	case androidPattern.MatchString(userAgent) && !strings.Contains(userAgent, "Windows Phone"):
+		return PlatformAndroid
+	case iosPattern.MatchString(userAgent):
+		return PlatformIOS
+	default:
+		return ""
+	}
+}
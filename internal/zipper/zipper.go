@@ -2,11 +2,18 @@ package zipper
 
 import (
 	"compress/gzip"
+	"context"
+	"github.com/repriest/url-shortener/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"io"
 	"net/http"
 	"strings"
 )
 
+var tracer = tracing.Tracer("zipper")
+
 // compressWriter реализует интерфейс http.ResponseWriter и позволяет прозрачно для сервера
 // сжимать передаваемые данные и выставлять правильные HTTP-заголовки
 type compressWriter struct {
@@ -80,6 +87,22 @@ func GzipMiddleware(h http.Handler) http.Handler {
 		// проверяем, что клиент умеет получать от сервера сжатые данные в формате gzip
 		acceptEncoding := r.Header.Get("Accept-Encoding")
 		supportsGzip := strings.Contains(acceptEncoding, "gzip")
+		// проверяем, что клиент отправил серверу сжатые данные в формате gzip
+		contentEncoding := r.Header.Get("Content-Encoding")
+		sendsGzip := strings.Contains(contentEncoding, "gzip")
+
+		// span охватывает и досылку сжатых данных, поэтому закрывается последним
+		var span trace.Span
+		if supportsGzip || sendsGzip {
+			var ctx context.Context
+			ctx, span = tracer.Start(r.Context(), "gzip", trace.WithAttributes(
+				attribute.Bool("gzip.compress", supportsGzip),
+				attribute.Bool("gzip.decompress", sendsGzip),
+			))
+			defer span.End()
+			r = r.WithContext(ctx)
+		}
+
 		if supportsGzip {
 			// оборачиваем оригинальный http.ResponseWriter новым с поддержкой сжатия
 			cw := newCompressWriter(w)
@@ -89,13 +112,12 @@ func GzipMiddleware(h http.Handler) http.Handler {
 			defer cw.Close()
 		}
 
-		// проверяем, что клиент отправил серверу сжатые данные в формате gzip
-		contentEncoding := r.Header.Get("Content-Encoding")
-		sendsGzip := strings.Contains(contentEncoding, "gzip")
 		if sendsGzip {
 			// оборачиваем тело запроса в io.Reader с поддержкой декомпрессии
 			cr, err := newCompressReader(r.Body)
 			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}